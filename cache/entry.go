@@ -0,0 +1,335 @@
+package cache
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cap on the freshness given by Last-Modified
+const MAX_HEURISTIC_FRESHNESS = 24 * time.Hour
+
+// Statuses that may be cached without explicit freshness (RFC 9110, 15.1)
+var HEURISTIC_STATUSES = []int{200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501}
+
+// Entry is a stored response and what is needed to tell its age
+type Entry struct {
+	Key string `json:"key"`
+
+	// Request headers named by the Vary of the response, with their values
+	Vary map[string]string `json:"vary,omitempty"`
+
+	Status  http.StatusCode   `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"-"`
+
+	// Length of Body, not kept in memory by disk stores
+	BodySize int64 `json:"body_size"`
+
+	RequestTime  time.Time `json:"request_time"`
+	ResponseTime time.Time `json:"response_time"`
+
+	// How long the response stays fresh, and its age when it was received
+	Freshness  time.Duration `json:"freshness"`
+	InitialAge time.Duration `json:"initial_age"`
+
+	// must-revalidate, proxy-revalidate or s-maxage: never served stale
+	MustRevalidate bool `json:"must_revalidate,omitempty"`
+
+	// stale-if-error and stale-while-revalidate (RFC 5861)
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+
+	// From the Cache-Tag response header, for purges
+	Tags []string `json:"tags,omitempty"`
+
+	// Base URLs of the upstream, for proxy_redirect
+	Origins []string `json:"origins,omitempty"`
+
+	Hits int64 `json:"hits"`
+}
+
+// NewEntry returns nil for responses that may not be stored
+func NewEntry(key string, req_headers map[string]string, res *http.HttpRes, req_time time.Time, res_time time.Time, valid []config.CacheValid) *Entry {
+	directives := ParseCacheControl(res.Headers["cache-control"])
+	req_directives := ParseCacheControl(req_headers["cache-control"])
+
+	if res.Status < http.StatusOK || res.Status == http.StatusPartialContent || res.Status == http.StatusNotModified {
+		return nil
+	}
+
+	if hasDirective(directives, "no-store") || hasDirective(directives, "private") || hasDirective(req_directives, "no-store") {
+		return nil
+	}
+
+	// Cookies are meant for one client
+	if res.Headers["set-cookie"] != "" {
+		return nil
+	}
+
+	// So are answers to authenticated requests, unless the upstream says otherwise
+	if req_headers["authorization"] != "" && !hasDirective(directives, "public") &&
+		!hasDirective(directives, "s-maxage") && !hasDirective(directives, "must-revalidate") {
+		return nil
+	}
+
+	vary_names := varyNames(res.Headers["vary"])
+	if slices.Contains(vary_names, "*") {
+		return nil
+	}
+
+	freshness, ok := explicitFreshness(directives, res.Headers, res_time)
+
+	if !ok {
+		freshness, ok = validFreshness(int(res.Status), valid)
+	}
+
+	if !ok {
+		freshness, ok = heuristicFreshness(int(res.Status), res.Headers, res_time)
+	}
+
+	if hasDirective(directives, "no-cache") {
+		freshness = 0
+	}
+
+	has_validator := res.Headers["etag"] != "" || res.Headers["last-modified"] != ""
+
+	// Nothing to serve without asking the upstream, and nothing to ask it with
+	if !ok || (freshness <= 0 && !has_validator) {
+		return nil
+	}
+
+	entry := &Entry{
+		Key:            key,
+		Status:         res.Status,
+		Headers:        maps.Clone(res.Headers),
+		Body:           res.Body,
+		BodySize:       int64(len(res.Body)),
+		RequestTime:    req_time,
+		ResponseTime:   res_time,
+		Freshness:      freshness,
+		InitialAge:     initialAge(res.Headers, req_time, res_time),
+		MustRevalidate: hasDirective(directives, "must-revalidate") || hasDirective(directives, "proxy-revalidate") || hasDirective(directives, "s-maxage"),
+		StaleIfError:   directiveSeconds(directives, "stale-if-error"),
+
+		StaleWhileRevalidate: directiveSeconds(directives, "stale-while-revalidate"),
+	}
+
+	// The age is given when the entry is served
+	delete(entry.Headers, "age")
+
+	// Tags are meant for the cache only
+	entry.Tags = ParseTags(entry.Headers["cache-tag"])
+	delete(entry.Headers, "cache-tag")
+
+	if len(vary_names) > 0 {
+		entry.Vary = map[string]string{}
+		for _, name := range vary_names {
+			entry.Vary[name] = req_headers[name]
+		}
+	}
+
+	return entry
+}
+
+// Revalidated merges the headers of a 304 into a copy of the entry, nil
+// when the 304 forbids storing
+func (e *Entry) Revalidated(req_headers map[string]string, not_modified *http.HttpRes, req_time time.Time, res_time time.Time, valid []config.CacheValid) *Entry {
+	merged := http.CreateHttpRes()
+	merged.Status = e.Status
+	merged.Headers = maps.Clone(e.Headers)
+	merged.Body = e.Body
+
+	if len(e.Tags) > 0 {
+		merged.Headers["cache-tag"] = strings.Join(e.Tags, ",")
+	}
+
+	for name, value := range not_modified.Headers {
+		// These describe the 304 itself
+		if name == "content-length" || name == "transfer-encoding" {
+			continue
+		}
+		merged.Headers[name] = value
+	}
+
+	revalidated := NewEntry(e.Key, req_headers, merged, req_time, res_time, valid)
+	if revalidated != nil {
+		revalidated.Hits = e.Hits
+	}
+
+	return revalidated
+}
+
+// Age of the entry at now (RFC 9111, 4.2.3)
+func (e *Entry) Age(now time.Time) time.Duration {
+	return e.InitialAge + now.Sub(e.ResponseTime)
+}
+
+func (e *Entry) IsFresh(now time.Time) bool {
+	return e.Age(now) < e.Freshness
+}
+
+func (e *Entry) Staleness(now time.Time) time.Duration {
+	return max(0, e.Age(now)-e.Freshness)
+}
+
+// Matches tells whether the entry is the variant selected by the request
+func (e *Entry) Matches(req_headers map[string]string) bool {
+	for name, value := range e.Vary {
+		if normalizeVaryValue(req_headers[name]) != normalizeVaryValue(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Response returns a copy of the stored response, with its Age at now
+func (e *Entry) Response(now time.Time) *http.HttpRes {
+	res := http.CreateHttpRes()
+	res.Status = e.Status
+	res.Headers = maps.Clone(e.Headers)
+	res.Headers["age"] = strconv.FormatInt(int64(e.Age(now)/time.Second), 10)
+	res.Body = e.Body
+
+	return res
+}
+
+func (e *Entry) Size() int64 {
+	size := int64(len(e.Key)) + e.BodySize
+	for name, value := range e.Headers {
+		size += int64(len(name) + len(value))
+	}
+	return size
+}
+
+// ParseTags splits a Cache-Tag header on commas and spaces
+func ParseTags(header string) []string {
+	return strings.FieldsFunc(header, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// ParseCacheControl maps the lowercased directives to their value
+func ParseCacheControl(header string) map[string]string {
+	directives := map[string]string{}
+
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(value, "\"")
+	}
+
+	return directives
+}
+
+func hasDirective(directives map[string]string, name string) bool {
+	_, ok := directives[name]
+	return ok
+}
+
+func directiveSeconds(directives map[string]string, name string) time.Duration {
+	seconds, err := strconv.Atoi(directives[name])
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// explicitFreshness reads s-maxage, max-age then Expires (RFC 9111, 4.2.1)
+func explicitFreshness(directives map[string]string, headers map[string]string, res_time time.Time) (time.Duration, bool) {
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if hasDirective(directives, name) {
+			return directiveSeconds(directives, name), true
+		}
+	}
+
+	if expires_header, ok := headers["expires"]; ok {
+		expires, err := ParseDate(expires_header)
+
+		// Invalid dates, like "0", mean already expired
+		if err != nil {
+			return 0, true
+		}
+
+		return expires.Sub(responseDate(headers, res_time)), true
+	}
+
+	return 0, false
+}
+
+func validFreshness(status int, valid []config.CacheValid) (time.Duration, bool) {
+	for _, rule := range valid {
+		if rule.Statuses == nil || slices.Contains(rule.Statuses, status) {
+			return rule.Duration, true
+		}
+	}
+	return 0, false
+}
+
+// heuristicFreshness is a tenth of the time since Last-Modified (RFC 9111, 4.2.2)
+func heuristicFreshness(status int, headers map[string]string, res_time time.Time) (time.Duration, bool) {
+	if !slices.Contains(HEURISTIC_STATUSES, status) {
+		return 0, false
+	}
+
+	last_modified, err := ParseDate(headers["last-modified"])
+	if err != nil {
+		return 0, false
+	}
+
+	return min(responseDate(headers, res_time).Sub(last_modified)/10, MAX_HEURISTIC_FRESHNESS), true
+}
+
+// initialAge is the corrected initial age of RFC 9111, 4.2.3
+func initialAge(headers map[string]string, req_time time.Time, res_time time.Time) time.Duration {
+	apparent_age := max(0, res_time.Sub(responseDate(headers, res_time)))
+
+	age_value := time.Duration(0)
+	if seconds, err := strconv.Atoi(strings.TrimSpace(headers["age"])); err == nil && seconds > 0 {
+		age_value = time.Duration(seconds) * time.Second
+	}
+
+	corrected_age := age_value + res_time.Sub(req_time)
+
+	return max(apparent_age, corrected_age)
+}
+
+func responseDate(headers map[string]string, res_time time.Time) time.Time {
+	if date, err := ParseDate(headers["date"]); err == nil {
+		return date
+	}
+	return res_time
+}
+
+func varyNames(header string) []string {
+	names := []string{}
+	for _, name := range strings.Split(header, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Values differing only in whitespace select the same variant
+func normalizeVaryValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// ParseDate reads the HTTP date formats (RFC 9110, 5.6.7)
+func ParseDate(value string) (time.Time, error) {
+	var t time.Time
+	var err error
+
+	for _, layout := range []string{time.RFC1123, time.RFC850, time.ANSIC} {
+		if t, err = time.Parse(layout, strings.TrimSpace(value)); err == nil {
+			return t, nil
+		}
+	}
+
+	return t, err
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"testing"
+	"time"
+)
+
+func TestNewEntryFreshness(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(time.RFC1123)
+	valid := []config.CacheValid{{Statuses: []int{200}, Duration: 5 * time.Minute}}
+
+	tests := []struct {
+		name    string
+		status  http.StatusCode
+		headers map[string]string
+		req     map[string]string
+		want    time.Duration // -1 when the response is not stored
+	}{
+		{"max-age", 200, map[string]string{"cache-control": "max-age=60"}, nil, time.Minute},
+		{"s-maxage wins", 200, map[string]string{"cache-control": "max-age=60, s-maxage=120"}, nil, 2 * time.Minute},
+		{"Expires", 200, map[string]string{"date": date, "expires": now.Add(time.Hour).Format(time.RFC1123)}, nil, time.Hour},
+		{"Invalid Expires", 200, map[string]string{"expires": "0", "etag": `"a"`}, nil, 0},
+		{"proxy_cache_valid", 200, map[string]string{}, nil, 5 * time.Minute},
+		{"Headers win over proxy_cache_valid", 200, map[string]string{"cache-control": "max-age=10"}, nil, 10 * time.Second},
+		{"Last-Modified heuristic", 404, map[string]string{"date": date, "last-modified": now.Add(-10 * time.Hour).Format(time.RFC1123)}, nil, time.Hour},
+		{"no-cache keeps validators", 200, map[string]string{"cache-control": "no-cache", "etag": `"a"`}, nil, 0},
+		{"No freshness", 500, map[string]string{}, nil, -1},
+		{"no-store", 200, map[string]string{"cache-control": "no-store, max-age=60"}, nil, -1},
+		{"private", 200, map[string]string{"cache-control": "private, max-age=60"}, nil, -1},
+		{"Set-Cookie", 200, map[string]string{"cache-control": "max-age=60", "set-cookie": "id=1"}, nil, -1},
+		{"Vary *", 200, map[string]string{"cache-control": "max-age=60", "vary": "*"}, nil, -1},
+		{"Authorization", 200, map[string]string{"cache-control": "max-age=60"}, map[string]string{"authorization": "Basic x"}, -1},
+		{"Authorization and public", 200, map[string]string{"cache-control": "public, max-age=60"}, map[string]string{"authorization": "Basic x"}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := http.CreateHttpRes()
+			res.Status = tt.status
+			res.Headers = tt.headers
+
+			req_headers := tt.req
+			if req_headers == nil {
+				req_headers = map[string]string{}
+			}
+
+			entry := NewEntry("key", req_headers, res, now, now, valid)
+
+			switch {
+			case entry == nil && tt.want != -1:
+				t.Errorf("expected the response to be stored")
+			case entry != nil && tt.want == -1:
+				t.Errorf("expected the response not to be stored, got freshness %s", entry.Freshness)
+			case entry != nil && entry.Freshness != tt.want:
+				t.Errorf("freshness = %s, want %s", entry.Freshness, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntryAge(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	res := http.CreateHttpRes()
+	res.Status = 200
+	res.Headers = map[string]string{
+		"cache-control": "max-age=100",
+		"age":           "30",
+		"date":          now.Add(-10 * time.Second).Format(time.RFC1123),
+	}
+
+	// Sent 2s before the response came back
+	entry := NewEntry("key", map[string]string{}, res, now.Add(-2*time.Second), now, nil)
+
+	if got := entry.Age(now); got != 32*time.Second {
+		t.Errorf("initial age = %s, want 32s", got)
+	}
+
+	later := now.Add(68 * time.Second)
+	if !entry.IsFresh(later.Add(-time.Second)) || entry.IsFresh(later) {
+		t.Errorf("expected the entry to expire 68s after it was received")
+	}
+
+	if got := entry.Response(later).Headers["age"]; got != "100" {
+		t.Errorf("Age header = %s, want 100", got)
+	}
+}
@@ -0,0 +1,478 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"dreamproxy/config"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_SIZE    = 256 << 20
+	DEFAULT_MEMORY_SIZE = 32 << 20
+)
+
+// Store keeps the entries of a cache block, their bodies on disk when it
+// has a path, and evicts the least recently used ones beyond its size
+type Store struct {
+	Name string
+
+	dir      string
+	max_size int64
+
+	mu   sync.Mutex
+	size int64
+
+	// Most recently used first
+	lru *list.List
+
+	// Elements of lru whose body a disk store keeps in memory
+	hot          *list.List
+	hot_elements map[*list.Element]*list.Element
+	memory_size  int64
+	memory_max   int64
+
+	// Variants of each key, as elements of lru
+	variants map[string][]*list.Element
+
+	// Keys being refreshed, closed once done
+	updates map[string]chan struct{}
+}
+
+var stores = map[string]*Store{}
+
+// Init opens the caches of the configuration
+func Init(cfgs []config.Cache) {
+	for _, cfg := range cfgs {
+		store, err := NewStore(cfg)
+
+		if err != nil {
+			panic(err)
+		}
+
+		stores[store.Name] = store
+	}
+}
+
+func Lookup(name string) *Store {
+	return stores[name]
+}
+
+func NewStore(cfg config.Cache) (*Store, error) {
+	store := &Store{
+		Name:     cfg.Name,
+		dir:      cfg.Path,
+		max_size: cfg.MaxSize,
+		lru:      list.New(),
+		variants: map[string][]*list.Element{},
+		updates:  map[string]chan struct{}{},
+
+		hot:          list.New(),
+		hot_elements: map[*list.Element]*list.Element{},
+		memory_max:   cfg.MemorySize,
+	}
+
+	if store.max_size <= 0 {
+		store.max_size = DEFAULT_MAX_SIZE
+	}
+
+	if store.memory_max <= 0 {
+		store.memory_max = DEFAULT_MEMORY_SIZE
+	}
+
+	if store.dir == "" {
+		return store, nil
+	}
+
+	if err := os.MkdirAll(store.dir, 0o700); err != nil {
+		return nil, fmt.Errorf("cache %s: %w", cfg.Name, err)
+	}
+
+	if err := store.load(); err != nil {
+		return nil, fmt.Errorf("cache %s: %w", cfg.Name, err)
+	}
+
+	return store, nil
+}
+
+// Get returns a copy of the variant of key selected by the request
+// headers, nil when there is none. Its headers must not be modified.
+func (s *Store) Get(key string, req_headers map[string]string) *Entry {
+	s.mu.Lock()
+
+	var found *list.Element
+
+	for _, element := range s.variants[key] {
+		if element.Value.(*Entry).Matches(req_headers) {
+			found = element
+			break
+		}
+	}
+
+	if found == nil {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.lru.MoveToFront(found)
+	entry := *found.Value.(*Entry)
+
+	hot_element, hot := s.hot_elements[found]
+	if hot {
+		s.hot.MoveToFront(hot_element)
+	}
+	s.mu.Unlock()
+
+	if s.dir == "" || hot {
+		return &entry
+	}
+
+	loaded, err := readEntry(s.entryPath(&entry))
+	if err != nil {
+		s.Delete(&entry)
+		return nil
+	}
+
+	// Only counted in memory
+	loaded.Hits = entry.Hits
+
+	s.mu.Lock()
+	if slices.Contains(s.variants[entry.Key], found) {
+		s.keepBody(found, loaded.Body)
+	}
+	s.mu.Unlock()
+
+	return loaded
+}
+
+// Put stores the entry, replacing the variant it matches if any
+func (s *Store) Put(entry *Entry) error {
+	size := entry.Size()
+
+	if size > s.max_size {
+		return nil
+	}
+
+	if s.dir != "" {
+		if err := writeEntry(s.entryPath(entry), entry); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, element := range s.variants[entry.Key] {
+		if slices.Equal(variantID(element.Value.(*Entry)), variantID(entry)) {
+			s.remove(element, false)
+			break
+		}
+	}
+
+	s.insert(entry, true)
+	s.evict()
+
+	return nil
+}
+
+// Delete removes an entry returned by Get
+func (s *Store) Delete(entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, element := range s.variants[entry.Key] {
+		if slices.Equal(variantID(element.Value.(*Entry)), variantID(entry)) {
+			s.remove(element, true)
+			return
+		}
+	}
+}
+
+// DeleteKey removes every variant of key
+func (s *Store) DeleteKey(key string) int {
+	return s.Purge(func(entry *Entry) bool { return entry.Key == key })
+}
+
+// Purge removes the entries matched, and returns how many there were
+func (s *Store) Purge(match func(entry *Entry) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+
+	for element := s.lru.Front(); element != nil; {
+		next := element.Next()
+
+		if match(element.Value.(*Entry)) {
+			s.remove(element, true)
+			purged++
+		}
+
+		element = next
+	}
+
+	return purged
+}
+
+// RecordHit counts a response served from an entry returned by Get
+func (s *Store) RecordHit(entry *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, element := range s.variants[entry.Key] {
+		if slices.Equal(variantID(element.Value.(*Entry)), variantID(entry)) {
+			element.Value.(*Entry).Hits++
+			return
+		}
+	}
+}
+
+// Entries returns copies of the entries without their body, most recently
+// used first
+func (s *Store) Entries() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Entry, 0, s.lru.Len())
+
+	for element := s.lru.Front(); element != nil; element = element.Next() {
+		entry := *element.Value.(*Entry)
+		entry.Body = nil
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func (s *Store) Size() (used int64, max int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size, s.max_size
+}
+
+// Lock makes the caller the one refreshing key, it must call unlock once
+// done. When another request already is, unlock is nil and done is closed
+// once it finished.
+func (s *Store) Lock(key string) (unlock func(), done <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if update, ok := s.updates[key]; ok {
+		return nil, update
+	}
+
+	update := make(chan struct{})
+	s.updates[key] = update
+
+	return func() {
+		s.mu.Lock()
+		delete(s.updates, key)
+		s.mu.Unlock()
+
+		close(update)
+	}, nil
+}
+
+func (s *Store) insert(entry *Entry, front bool) {
+	body := entry.Body
+
+	if s.dir != "" {
+		// The body is only kept by keepBody
+		stored := *entry
+		stored.Body = nil
+		entry = &stored
+	}
+
+	var element *list.Element
+	if front {
+		element = s.lru.PushFront(entry)
+	} else {
+		element = s.lru.PushBack(entry)
+	}
+
+	s.variants[entry.Key] = append(s.variants[entry.Key], element)
+	s.size += entry.Size()
+
+	if s.dir != "" && front {
+		s.keepBody(element, body)
+	}
+}
+
+// keepBody keeps the body of an element of a disk store in memory,
+// dropping those of the least recently used ones beyond memory_max
+func (s *Store) keepBody(element *list.Element, body []byte) {
+	if _, ok := s.hot_elements[element]; ok || int64(len(body)) > s.memory_max {
+		return
+	}
+
+	entry := element.Value.(*Entry)
+	entry.Body = body
+	s.memory_size += int64(len(body))
+	s.hot_elements[element] = s.hot.PushFront(element)
+
+	for s.memory_size > s.memory_max {
+		s.dropBody(s.hot.Back().Value.(*list.Element))
+	}
+}
+
+func (s *Store) dropBody(element *list.Element) {
+	hot_element, ok := s.hot_elements[element]
+	if !ok {
+		return
+	}
+
+	entry := element.Value.(*Entry)
+
+	s.hot.Remove(hot_element)
+	delete(s.hot_elements, element)
+	s.memory_size -= int64(len(entry.Body))
+	entry.Body = nil
+}
+
+// remove drops an element, and its file when delete_file is set
+func (s *Store) remove(element *list.Element, delete_file bool) {
+	entry := element.Value.(*Entry)
+
+	s.dropBody(element)
+	s.lru.Remove(element)
+	s.size -= entry.Size()
+
+	variants := slices.DeleteFunc(s.variants[entry.Key], func(e *list.Element) bool { return e == element })
+	if len(variants) == 0 {
+		delete(s.variants, entry.Key)
+	} else {
+		s.variants[entry.Key] = variants
+	}
+
+	if s.dir != "" && delete_file {
+		os.Remove(s.entryPath(entry))
+	}
+}
+
+func (s *Store) evict() {
+	for s.size > s.max_size && s.lru.Len() > 0 {
+		s.remove(s.lru.Back(), true)
+	}
+}
+
+func (s *Store) entryPath(entry *Entry) string {
+	sum := sha256.Sum256([]byte(strings.Join(variantID(entry), "\n")))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+// load indexes the entries left on disk by a previous run, the most
+// recently received ones first
+func (s *Store) load() error {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+
+	entries := []*Entry{}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(s.dir, file.Name())
+		entry, err := readEntry(path)
+
+		if err != nil {
+			os.Remove(path)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ResponseTime.After(entries[j].ResponseTime)
+	})
+
+	for _, entry := range entries {
+		s.insert(entry, false)
+	}
+
+	s.evict()
+
+	return nil
+}
+
+// variantID tells variants of a key apart by the request headers they were
+// selected with
+func variantID(entry *Entry) []string {
+	id := []string{entry.Key}
+
+	names := make([]string, 0, len(entry.Vary))
+	for name := range entry.Vary {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		id = append(id, name+":"+normalizeVaryValue(entry.Vary[name]))
+	}
+
+	return id
+}
+
+// Entry files hold the metadata as a JSON line followed by the body
+func writeEntry(path string, entry *Entry) error {
+	metadata, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Written aside then renamed, a reader never sees half an entry
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(append(append(metadata, '\n'), entry.Body...))
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+func readEntry(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, body, found := bytes.Cut(data, []byte("\n"))
+	if !found {
+		return nil, fmt.Errorf("truncated cache entry %s", path)
+	}
+
+	entry := &Entry{}
+	if err := json.Unmarshal(metadata, entry); err != nil {
+		return nil, err
+	}
+
+	entry.Body = body
+
+	return entry, nil
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestEntry(key string, body string, vary map[string]string) *Entry {
+	res := http.CreateHttpRes()
+	res.Status = 200
+	res.Headers = map[string]string{"cache-control": "max-age=60"}
+	res.Body = []byte(body)
+
+	req_headers := map[string]string{}
+	for name, value := range vary {
+		req_headers[name] = value
+		res.Headers["vary"] = name
+	}
+
+	now := time.Now()
+	return NewEntry(key, req_headers, res, now, now, nil)
+}
+
+func TestStoreVariants(t *testing.T) {
+	store, _ := NewStore(config.Cache{Name: "test"})
+
+	store.Put(newTestEntry("/page", "gzip", map[string]string{"accept-encoding": "gzip"}))
+	store.Put(newTestEntry("/page", "plain", map[string]string{"accept-encoding": ""}))
+
+	if entry := store.Get("/page", map[string]string{"accept-encoding": "gzip"}); entry == nil || string(entry.Body) != "gzip" {
+		t.Errorf("expected the gzip variant")
+	}
+	if entry := store.Get("/page", map[string]string{}); entry == nil || string(entry.Body) != "plain" {
+		t.Errorf("expected the plain variant")
+	}
+	if entry := store.Get("/page", map[string]string{"accept-encoding": "br"}); entry != nil {
+		t.Errorf("expected no variant for br")
+	}
+
+	store.DeleteKey("/page")
+	if entry := store.Get("/page", map[string]string{}); entry != nil {
+		t.Errorf("expected the variants to be deleted")
+	}
+}
+
+func TestStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	size := newTestEntry("/a", "0123456789", nil).Size()
+	store, _ := NewStore(config.Cache{Name: "test", MaxSize: 2 * size})
+
+	store.Put(newTestEntry("/a", "0123456789", nil))
+	store.Put(newTestEntry("/b", "0123456789", nil))
+	store.Get("/a", map[string]string{})
+	store.Put(newTestEntry("/c", "0123456789", nil))
+
+	if store.Get("/b", map[string]string{}) != nil {
+		t.Errorf("expected /b to be evicted")
+	}
+	if store.Get("/a", map[string]string{}) == nil || store.Get("/c", map[string]string{}) == nil {
+		t.Errorf("expected /a and /c to be kept")
+	}
+}
+
+func TestStoreOnDisk(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewStore(config.Cache{Name: "test", Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Put(newTestEntry("/page", "on disk", nil))
+
+	// Entries survive a restart
+	reopened, err := NewStore(config.Cache{Name: "test", Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := reopened.Get("/page", map[string]string{})
+	if entry == nil || string(entry.Body) != "on disk" {
+		t.Fatalf("expected the entry to be loaded from disk")
+	}
+	if !entry.IsFresh(time.Now()) {
+		t.Errorf("expected the loaded entry to be fresh")
+	}
+}
+
+func TestStoreMemoryTier(t *testing.T) {
+	dir := t.TempDir()
+
+	// Room for one body in memory
+	store, err := NewStore(config.Cache{Name: "test", Path: dir, MemorySize: 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestEntry("/a", "0123456789", nil)
+	b := newTestEntry("/b", "abcdefghij", nil)
+	store.Put(a)
+	store.Put(b)
+
+	// Served from memory, the file is not read
+	os.Remove(store.entryPath(b))
+	if entry := store.Get("/b", map[string]string{}); entry == nil || string(entry.Body) != "abcdefghij" {
+		t.Fatalf("expected /b from memory")
+	}
+
+	// Read from disk, then kept in memory in place of /b
+	if entry := store.Get("/a", map[string]string{}); entry == nil || string(entry.Body) != "0123456789" {
+		t.Fatalf("expected /a from disk")
+	}
+	os.Remove(store.entryPath(a))
+	if entry := store.Get("/a", map[string]string{}); entry == nil || string(entry.Body) != "0123456789" {
+		t.Fatalf("expected /a from memory")
+	}
+	if entry := store.Get("/b", map[string]string{}); entry != nil {
+		t.Errorf("expected /b to have left memory")
+	}
+}
+
+func TestStoreLock(t *testing.T) {
+	store, _ := NewStore(config.Cache{Name: "test"})
+
+	unlock, done := store.Lock("/page")
+	if unlock == nil || done != nil {
+		t.Fatalf("expected the first caller to get the lock")
+	}
+
+	second_unlock, second_done := store.Lock("/page")
+	if second_unlock != nil || second_done == nil {
+		t.Fatalf("expected the second caller to wait")
+	}
+
+	if other, _ := store.Lock("/other"); other == nil {
+		t.Fatalf("expected keys to be locked separately")
+	}
+
+	unlock()
+
+	select {
+	case <-second_done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected waiters to be released on unlock")
+	}
+
+	if again, _ := store.Lock("/page"); again == nil {
+		t.Errorf("expected the lock to be free again")
+	}
+}
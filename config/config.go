@@ -1,7 +1,15 @@
 package config
 
+import (
+	"net/netip"
+	"regexp"
+	"time"
+)
+
 type Config struct {
-	Servers []Server `json:"servers"`
+	Servers   []Server   `json:"servers"`
+	Upstreams []Upstream `json:"upstreams,omitempty"`
+	Caches    []Cache    `json:"caches,omitempty"`
 }
 
 type Server struct {
@@ -11,11 +19,28 @@ type Server struct {
 	AccessLog string     `json:"access_log"`
 	SSL       *SSLConfig `json:"ssl,omitempty"`
 	Locations []Location `json:"locations"`
+
+	// Peers allowed to tell the real client address through RealIPHeader
+	RealIPFrom      []netip.Prefix `json:"set_real_ip_from,omitempty"`
+	RealIPHeader    string         `json:"real_ip_header,omitempty"`
+	RealIPRecursive bool           `json:"real_ip_recursive,omitempty"`
+
+	// Proxies absolute-form and CONNECT requests to any destination allowed
+	// by the host[:port] patterns, e.g. "*.example.com:443" or "10.0.0.0/8"
+	ForwardProxy      bool     `json:"forward_proxy,omitempty"`
+	ForwardProxyAllow []string `json:"forward_proxy_allow,omitempty"`
+	ForwardProxyDeny  []string `json:"forward_proxy_deny,omitempty"`
+
+	// Basic auth password hashes required in Proxy-Authorization, by user name
+	ForwardProxyUsers map[string]string `json:"-"`
 }
 
 type Listen struct {
 	Port int  `json:"port"`
 	SSL  bool `json:"ssl"`
+
+	// Connections start with a PROXY protocol header
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
 }
 
 type SSLConfig struct {
@@ -27,4 +52,250 @@ type Location struct {
 	Path      string `json:"path"`
 	Root      string `json:"root,omitempty"`
 	ProxyPass string `json:"proxy_pass,omitempty"`
+
+	// ProxyPass parsed at load, nil without proxy_pass
+	ProxyTarget *ProxyTarget `json:"proxy_target,omitempty"`
+
+	// Conditions under which a request is passed to the next upstream server,
+	// nil means "error timeout"
+	NextUpstream        []string      `json:"proxy_next_upstream,omitempty"`
+	NextUpstreamTries   int           `json:"proxy_next_upstream_tries,omitempty"`
+	NextUpstreamTimeout time.Duration `json:"proxy_next_upstream_timeout,omitempty"`
+
+	ConnectTimeout time.Duration `json:"proxy_connect_timeout,omitempty"`
+	SendTimeout    time.Duration `json:"proxy_send_timeout,omitempty"`
+	ReadTimeout    time.Duration `json:"proxy_read_timeout,omitempty"`
+
+	// Adds an RFC 7239 Forwarded header next to the X-Forwarded-* ones
+	AddForwarded bool `json:"proxy_add_forwarded,omitempty"`
+
+	// Request headers sent to the upstream, values may use $variables.
+	// An empty value removes the header.
+	ProxySetHeaders []Header `json:"proxy_set_header,omitempty"`
+
+	// Upstream response headers kept from the client, and default hidden
+	// ones (Server, Date, X-Accel-*) let through
+	ProxyHideHeaders []string `json:"proxy_hide_header,omitempty"`
+	ProxyPassHeaders []string `json:"proxy_pass_header,omitempty"`
+
+	// Host sent upstream: "off" (default) keeps the client one, "on" uses the
+	// proxy_pass host, anything else is used as the value
+	ProxySetHost string `json:"proxy_set_host,omitempty"`
+
+	// Rewrites of upstream Location and Refresh headers, nil means
+	// "default" unless ProxyRedirectOff is set
+	ProxyRedirects   []ProxyRedirect `json:"proxy_redirect,omitempty"`
+	ProxyRedirectOff bool            `json:"proxy_redirect_off,omitempty"`
+
+	// Upstream redirects followed before answering the client, 0 passes
+	// them through
+	FollowRedirects int `json:"proxy_follow_redirects,omitempty"`
+
+	// Response headers changed before the response is sent, for proxied
+	// and static responses alike
+	AddHeaders    []ResponseHeader `json:"add_header,omitempty"`
+	RemoveHeaders []string         `json:"remove_header,omitempty"`
+
+	// Applied in order to the request path before it is handled
+	Rewrites []Rewrite `json:"rewrite,omitempty"`
+
+	// Name of the cache block storing the upstream responses
+	ProxyCache string `json:"proxy_cache,omitempty"`
+
+	// Empty means "$scheme$proxy_host$request_uri"
+	ProxyCacheKey string `json:"proxy_cache_key,omitempty"`
+
+	// Freshness of responses that do not tell their own
+	ProxyCacheValid []CacheValid `json:"proxy_cache_valid,omitempty"`
+
+	// A single request per key refreshes the cache, the others wait for it
+	ProxyCacheLock        bool          `json:"proxy_cache_lock,omitempty"`
+	ProxyCacheLockTimeout time.Duration `json:"proxy_cache_lock_timeout,omitempty"`
+
+	// Stale serving conditions, e.g. "error", "updating" or "http_5xx"
+	ProxyCacheUseStale []string `json:"proxy_cache_use_stale,omitempty"`
+
+	ProxyCacheBackgroundUpdate bool `json:"proxy_cache_background_update,omitempty"`
+
+	ProxyCachePurge bool `json:"proxy_cache_purge,omitempty"`
+
+	CacheAdmin string `json:"cache_admin,omitempty"`
+
+	// Loopback only when empty. CacheAdminUsers holds password hashes.
+	CacheAdminAllow []netip.Prefix    `json:"cache_admin_allow,omitempty"`
+	CacheAdminUsers map[string]string `json:"-"`
+
+	// Answers the request itself, ahead of Root and ProxyPass
+	Return *Return `json:"return,omitempty"`
+
+	// TLS settings toward https:// upstreams, nil for the defaults
+	ProxySSL *ProxySSL `json:"proxy_ssl,omitempty"`
+
+	// "host:port" or "unix:/path"
+	FastCGIPass string `json:"fastcgi_pass,omitempty"`
+
+	// An empty value removes the parameter
+	FastCGIParams []CGIParam `json:"fastcgi_param,omitempty"`
+
+	// File name appended to SCRIPT_NAME when the URI ends with a slash
+	FastCGIIndex string `json:"fastcgi_index,omitempty"`
+
+	// Copies of the requests go to the proxy_pass of the location named by
+	// Mirror, or to MirrorPass
+	Mirror       string       `json:"mirror,omitempty"`
+	MirrorPass   string       `json:"mirror_pass,omitempty"`
+	MirrorTarget *ProxyTarget `json:"mirror_target,omitempty"`
+
+	// Set on the locations named by mirror, clients cannot reach them
+	Internal bool `json:"internal,omitempty"`
+
+	SCGIPass    string     `json:"scgi_pass,omitempty"`
+	SCGIParams  []CGIParam `json:"scgi_param,omitempty"`
+	UWSGIPass   string     `json:"uwsgi_pass,omitempty"`
+	UWSGIParams []CGIParam `json:"uwsgi_param,omitempty"`
+
+	// Scripts are killed after CGITimeout or past CGIMaxOutputSize
+	CGIRoot          string        `json:"cgi_root,omitempty"`
+	CGITimeout       time.Duration `json:"cgi_timeout,omitempty"`
+	CGIMaxOutputSize int64         `json:"cgi_max_output_size,omitempty"`
+}
+
+// ProxyTarget is the upstream named by proxy_pass
+type ProxyTarget struct {
+	// "http" or "https"
+	Scheme string `json:"scheme"`
+
+	// Name or address, without brackets for IPv6 literals, an upstream
+	// group name or a "unix:/path" socket
+	Host string `json:"host"`
+
+	// Port as written, or the default port of the scheme. Zero for sockets.
+	Port         int  `json:"port,omitempty"`
+	ExplicitPort bool `json:"explicit_port,omitempty"`
+
+	// Host and port as written, e.g. "[::1]:8000"
+	Authority string `json:"authority"`
+
+	// Path replacing the location prefix, empty to pass the request URI
+	// unchanged
+	URI string `json:"uri,omitempty"`
+}
+
+type ProxySSL struct {
+	// Disables the verification of the upstream certificate
+	SkipVerify bool `json:"skip_verify,omitempty"`
+
+	// PEM bundle of the CAs trusted for upstreams, system roots when empty
+	TrustedCertificate string `json:"trusted_certificate,omitempty"`
+
+	// SNI sent to the upstream and name verified: "on" (default) uses the
+	// proxy_pass host, "off" sends none, anything else is used as is
+	ServerName string `json:"server_name,omitempty"`
+
+	// Client certificate presented to upstreams requiring mTLS
+	Certificate    string `json:"certificate,omitempty"`
+	CertificateKey string `json:"certificate_key,omitempty"`
+}
+
+// Return is the response of the return directive. Text, which may use
+// variables, is the Location of redirects and the body of anything else.
+type Return struct {
+	Code int    `json:"code"`
+	Text string `json:"text,omitempty"`
+}
+
+// Rewrite replaces the request path when Regex matches it. Replacement
+// may use captures ($1..$9) and variables. Flag is one of REWRITE_FLAGS or
+// empty to carry on with the next rewrite.
+type Rewrite struct {
+	Regex       *regexp.Regexp `json:"regex"`
+	Replacement string         `json:"replacement"`
+	Flag        string         `json:"flag,omitempty"`
+}
+
+// ResponseHeader is only added to successful and redirect responses
+// unless Always is set
+type ResponseHeader struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Always bool   `json:"always,omitempty"`
+}
+
+// ProxyRedirect replaces the From prefix of redirect URLs with To. The
+// default one maps the proxied server URL back to the location.
+type ProxyRedirect struct {
+	Default bool   `json:"default,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+}
+
+type Header struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CGIParam is skipped when IfNotEmpty is set and its value is empty
+type CGIParam struct {
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+	IfNotEmpty bool   `json:"if_not_empty,omitempty"`
+}
+
+type Upstream struct {
+	Name        string           `json:"name"`
+	Servers     []UpstreamServer `json:"servers"`
+	HealthCheck *HealthCheck     `json:"health_check,omitempty"`
+
+	// Passive checks, disabled while MaxFails is zero
+	MaxFails         int           `json:"max_fails,omitempty"`
+	FailTimeout      time.Duration `json:"fail_timeout,omitempty"`
+	HalfOpenRequests int           `json:"half_open_requests,omitempty"`
+
+	// Connection pool limits, applied to each server of the group
+	Keepalive        int           `json:"keepalive,omitempty"`
+	KeepaliveTimeout time.Duration `json:"keepalive_timeout,omitempty"`
+	MaxConns         int           `json:"max_conns,omitempty"`
+
+	// Announce the client address to the servers with a PROXY protocol header
+	ProxyProtocol bool `json:"proxy_protocol,omitempty"`
+}
+
+// Cache is a response store shared by the locations naming it in proxy_cache
+type Cache struct {
+	Name string `json:"name"`
+
+	// Directory of the entries, kept in memory when empty
+	Path string `json:"path,omitempty"`
+
+	// Zero for the default
+	MaxSize int64 `json:"max_size,omitempty"`
+
+	// Bodies kept in memory in front of the disk
+	MemorySize int64 `json:"memory_size,omitempty"`
+}
+
+// CacheValid is a proxy_cache_valid rule, nil Statuses matches any status
+type CacheValid struct {
+	Statuses []int         `json:"statuses,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+type UpstreamServer struct {
+	Address string `json:"address"`
+
+	// Share of the requests relative to the other servers, 1 when unset
+	Weight int `json:"weight,omitempty"`
+
+	// Marked unavailable, it takes no request and is not checked
+	Down bool `json:"down,omitempty"`
+}
+
+// Zero values are replaced by defaults when the checks start
+type HealthCheck struct {
+	Interval       time.Duration `json:"interval"`
+	Timeout        time.Duration `json:"timeout"`
+	Path           string        `json:"path"`
+	ExpectedStatus int           `json:"expected_status"`
+	Rise           int           `json:"rise"`
+	Fall           int           `json:"fall"`
 }
@@ -11,7 +11,11 @@ func LoadDreamFile(config_file_path string) Config {
 		panic(err)
 	}
 
-	lexer := NewLexer(string(config_bin))
+	return ParseDreamFile(string(config_bin))
+}
+
+func ParseDreamFile(input string) Config {
+	lexer := NewLexer(input)
 
 	var tokens []Token
 
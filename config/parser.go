@@ -2,11 +2,57 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
+var NEXT_UPSTREAM_CONDITIONS = []string{
+	"error",
+	"timeout",
+	"http_500",
+	"http_502",
+	"http_503",
+	"http_504",
+	"http_404",
+	"non_idempotent",
+	"off",
+}
+
+var CACHE_USE_STALE_CONDITIONS = []string{
+	"error",
+	"timeout",
+	"updating",
+	"http_500",
+	"http_502",
+	"http_503",
+	"http_504",
+	"http_5xx",
+	"http_403",
+	"http_404",
+	"http_429",
+	"off",
+}
+
+var REWRITE_FLAGS = []string{
+	"last",
+	"break",
+	"redirect",
+	"permanent",
+}
+
+// Ports of proxy_pass URLs that do not give one
+var DEFAULT_PORTS = map[string]int{
+	"http":  80,
+	"https": 443,
+}
+
 type TokenType int
 
 const (
@@ -47,21 +93,65 @@ func (l *Lexer) NextToken() Token {
 		return Token{Type: TokenSymbol, Value: string(ch), Line: l.line}
 	}
 
-	// Numbers
-	if unicode.IsDigit(rune(ch)) {
-		start := l.pos
-		for l.pos < len(l.input) && unicode.IsDigit(rune(l.input[l.pos])) {
-			l.pos++
-		}
-		return Token{Type: TokenNumber, Value: l.input[start:l.pos], Line: l.line}
+	// Quoted strings
+	if ch == '"' || ch == '\'' {
+		return l.readString(ch)
 	}
 
-	// Identifiers / strings
+	// Identifiers / numbers
 	start := l.pos
 	for l.pos < len(l.input) && !unicode.IsSpace(rune(l.input[l.pos])) && !strings.ContainsRune("{};", rune(l.input[l.pos])) {
 		l.pos++
 	}
-	return Token{Type: TokenIdentifier, Value: l.input[start:l.pos], Line: l.line}
+	word := l.input[start:l.pos]
+
+	// Only whole words made of digits are numbers, so "5s" or "10.0.0.1" stay identifiers
+	if isNumber(word) {
+		return Token{Type: TokenNumber, Value: word, Line: l.line}
+	}
+	return Token{Type: TokenIdentifier, Value: word, Line: l.line}
+}
+
+// readString reads a quoted value, a backslash escapes the quote or itself
+func (l *Lexer) readString(quote byte) Token {
+	line := l.line
+	var sb strings.Builder
+
+	l.pos++ // opening quote
+
+	for l.pos < len(l.input) && l.input[l.pos] != quote {
+		ch := l.input[l.pos]
+
+		// Other backslashes are kept, e.g. in "^/item/(\d+)$"
+		if ch == '\\' && l.pos+1 < len(l.input) && (l.input[l.pos+1] == quote || l.input[l.pos+1] == '\\') {
+			l.pos++
+			ch = l.input[l.pos]
+		}
+
+		if ch == '\n' {
+			l.line++
+		}
+
+		sb.WriteByte(ch)
+		l.pos++
+	}
+
+	if l.pos >= len(l.input) {
+		panic(fmt.Sprintf("unterminated string at line %d", line))
+	}
+
+	l.pos++ // closing quote
+
+	return Token{Type: TokenString, Value: sb.String(), Line: line}
+}
+
+func isNumber(word string) bool {
+	for _, ch := range word {
+		if !unicode.IsDigit(ch) {
+			return false
+		}
+	}
+	return word != ""
 }
 
 func (l *Lexer) skipWhitespace() {
@@ -109,22 +199,194 @@ func (p *Parser) expectSymbol(val string) {
 func (p *Parser) ParseConfig() Config {
 	cfg := Config{}
 
-	// Expect "servers" identifier
-	serversTok := p.consume()
-	if serversTok.Type != TokenIdentifier || serversTok.Value != "servers" {
-		panic(fmt.Sprintf("expected 'servers' at line %d, got %s", serversTok.Line, serversTok.Value))
+	for p.peek().Type != TokenEOF {
+		tok := p.consume()
+
+		switch {
+		case tok.Type == TokenIdentifier && tok.Value == "servers":
+			p.expectSymbol("{")
+
+			// Parse server blocks
+			for p.peek().Type != TokenSymbol || p.peek().Value != "}" {
+				server := p.parseServer()
+				cfg.Servers = append(cfg.Servers, server)
+			}
+
+			p.expectSymbol("}")
+		case tok.Type == TokenIdentifier && tok.Value == "upstream":
+			upstream := p.parseUpstream()
+			cfg.Upstreams = append(cfg.Upstreams, upstream)
+		case tok.Type == TokenIdentifier && tok.Value == "cache":
+			cache := p.parseCache()
+			cfg.Caches = append(cfg.Caches, cache)
+		default:
+			panic(fmt.Sprintf("expected 'servers', 'upstream' or 'cache' at line %d, got %s", tok.Line, tok.Value))
+		}
 	}
 
+	checkForwardProxyListens(cfg.Servers)
+
+	return cfg
+}
+
+// checkForwardProxyListens requires forward proxies to listen on a port of
+// their own, they would otherwise take the absolute-form and CONNECT
+// requests meant for the other servers of the port
+func checkForwardProxyListens(servers []Server) {
+	for i, forward := range servers {
+		if !forward.ForwardProxy {
+			continue
+		}
+
+		for j, other := range servers {
+			if i != j && other.Listen.Port == forward.Listen.Port {
+				panic(fmt.Sprintf("server %s: forward_proxy needs a listen port of its own, %d is shared with %s", forward.Name, forward.Listen.Port, other.Name))
+			}
+		}
+	}
+}
+
+func (p *Parser) parseUpstream() Upstream {
+	upstream := Upstream{}
+
+	nameTok := p.consume()
+	if nameTok.Type != TokenIdentifier {
+		panic(fmt.Sprintf("expected upstream name at line %d", nameTok.Line))
+	}
+	upstream.Name = nameTok.Value
 	p.expectSymbol("{")
 
-	// Parse server blocks
 	for p.peek().Type != TokenSymbol || p.peek().Value != "}" {
-		server := p.parseServer()
-		cfg.Servers = append(cfg.Servers, server)
+		key, args := p.parseDirective()
+		p.applyUpstreamDirective(&upstream, key, args)
 	}
 
 	p.expectSymbol("}")
-	return cfg
+
+	if len(upstream.Servers) == 0 {
+		panic(fmt.Sprintf("upstream %s has no servers", upstream.Name))
+	}
+
+	return upstream
+}
+
+func (p *Parser) applyUpstreamDirective(u *Upstream, key string, args []string) {
+	value := firstArg(args)
+
+	switch key {
+	case "server":
+		if value == "" {
+			panic(fmt.Sprintf("upstream %s: server requires an address", u.Name))
+		}
+		u.Servers = append(u.Servers, parseUpstreamServer(u.Name, value, args[1:]))
+	case "health_check":
+		if u.HealthCheck == nil {
+			u.HealthCheck = &HealthCheck{}
+		}
+	case "health_check_interval":
+		if u.HealthCheck == nil {
+			u.HealthCheck = &HealthCheck{}
+		}
+		u.HealthCheck.Interval = parseDuration(key, value)
+	case "health_check_timeout":
+		if u.HealthCheck == nil {
+			u.HealthCheck = &HealthCheck{}
+		}
+		u.HealthCheck.Timeout = parseDuration(key, value)
+	case "health_check_path":
+		if u.HealthCheck == nil {
+			u.HealthCheck = &HealthCheck{}
+		}
+		u.HealthCheck.Path = value
+	case "health_check_status":
+		if u.HealthCheck == nil {
+			u.HealthCheck = &HealthCheck{}
+		}
+		u.HealthCheck.ExpectedStatus = parseInt(key, value)
+	case "health_check_rise":
+		if u.HealthCheck == nil {
+			u.HealthCheck = &HealthCheck{}
+		}
+		u.HealthCheck.Rise = parseInt(key, value)
+	case "health_check_fall":
+		if u.HealthCheck == nil {
+			u.HealthCheck = &HealthCheck{}
+		}
+		u.HealthCheck.Fall = parseInt(key, value)
+	case "max_fails":
+		u.MaxFails = parseInt(key, value)
+	case "fail_timeout":
+		u.FailTimeout = parseDuration(key, value)
+	case "half_open_requests":
+		u.HalfOpenRequests = parseInt(key, value)
+	case "keepalive":
+		u.Keepalive = parseInt(key, value)
+	case "keepalive_timeout":
+		u.KeepaliveTimeout = parseDuration(key, value)
+	case "max_conns":
+		u.MaxConns = parseInt(key, value)
+	case "proxy_protocol":
+		u.ProxyProtocol = parseFlag(key, value)
+	default:
+		panic(fmt.Sprintf("unknown upstream directive %s", key))
+	}
+}
+
+// parseUpstreamServer reads a server line: an address followed by
+// weight=<n> and down parameters
+func parseUpstreamServer(upstream string, address string, params []string) UpstreamServer {
+	server := UpstreamServer{Address: address}
+
+	for _, param := range params {
+		if weight, ok := strings.CutPrefix(param, "weight="); ok {
+			server.Weight = parseInt("weight", weight)
+
+			if server.Weight < 1 {
+				panic(fmt.Sprintf("upstream %s: weight of %s must be positive", upstream, address))
+			}
+			continue
+		}
+
+		if param == "down" {
+			server.Down = true
+			continue
+		}
+
+		panic(fmt.Sprintf("upstream %s: unknown server parameter %s", upstream, param))
+	}
+
+	return server
+}
+
+func (p *Parser) parseCache() Cache {
+	cache := Cache{}
+
+	nameTok := p.consume()
+	if nameTok.Type != TokenIdentifier {
+		panic(fmt.Sprintf("expected cache name at line %d", nameTok.Line))
+	}
+	cache.Name = nameTok.Value
+	p.expectSymbol("{")
+
+	for p.peek().Type != TokenSymbol || p.peek().Value != "}" {
+		key, args := p.parseDirective()
+		value := firstArg(args)
+
+		switch key {
+		case "path":
+			cache.Path = value
+		case "max_size":
+			cache.MaxSize = parseSize(key, value)
+		case "memory_size":
+			cache.MemorySize = parseSize(key, value)
+		default:
+			panic(fmt.Sprintf("unknown cache directive %s", key))
+		}
+	}
+
+	p.expectSymbol("}")
+
+	return cache
 }
 
 func (p *Parser) parseServer() Server {
@@ -144,15 +406,42 @@ func (p *Parser) parseServer() Server {
 			loc := p.parseLocation()
 			server.Locations = append(server.Locations, loc)
 		} else {
-			key, value := p.parseDirective()
-			p.applyDirective(&server, key, value)
+			key, args := p.parseDirective()
+			p.applyDirective(&server, key, args)
 		}
 	}
 
 	p.expectSymbol("}")
+
+	for _, loc := range server.Locations {
+		if (loc.Mirror != "" || loc.MirrorTarget != nil) && loc.ProxyTarget == nil {
+			panic(fmt.Sprintf("location %s: only proxied requests are mirrored, it has no proxy_pass", loc.Path))
+		}
+
+		if loc.Mirror == "" {
+			continue
+		}
+
+		mirror := findMirror(server.Locations, loc.Mirror)
+		if mirror == nil {
+			panic(fmt.Sprintf("mirror %s of location %s names no location with proxy_pass", loc.Mirror, loc.Path))
+		}
+		mirror.Internal = true
+	}
+
 	return server
 }
 
+// findMirror returns the location named by a mirror directive
+func findMirror(locations []Location, path string) *Location {
+	for i := range locations {
+		if locations[i].Path == path && locations[i].ProxyTarget != nil {
+			return &locations[i]
+		}
+	}
+	return nil
+}
+
 func (p *Parser) parseLocation() Location {
 	loc := Location{}
 	p.consume() // consume 'location'
@@ -164,12 +453,150 @@ func (p *Parser) parseLocation() Location {
 	p.expectSymbol("{")
 
 	for p.peek().Type != TokenSymbol || p.peek().Value != "}" {
-		key, value := p.parseDirective()
+		key, args := p.parseDirective()
+		value := firstArg(args)
 		switch key {
 		case "root":
 			loc.Root = value
 		case "proxy_pass":
 			loc.ProxyPass = value
+			loc.ProxyTarget = parseProxyPass(key, value, p.peek().Line)
+		case "proxy_next_upstream":
+			for _, arg := range args {
+				if !slices.Contains(NEXT_UPSTREAM_CONDITIONS, arg) {
+					panic(fmt.Sprintf("invalid proxy_next_upstream value %s at line %d", arg, p.peek().Line))
+				}
+			}
+			loc.NextUpstream = args
+		case "proxy_next_upstream_tries":
+			loc.NextUpstreamTries = parseInt(key, value)
+		case "proxy_next_upstream_timeout":
+			loc.NextUpstreamTimeout = parseDuration(key, value)
+		case "proxy_connect_timeout":
+			loc.ConnectTimeout = parseDuration(key, value)
+		case "proxy_send_timeout":
+			loc.SendTimeout = parseDuration(key, value)
+		case "proxy_read_timeout":
+			loc.ReadTimeout = parseDuration(key, value)
+		case "proxy_add_forwarded":
+			loc.AddForwarded = parseFlag(key, value)
+		case "proxy_set_header":
+			if len(args) != 2 {
+				panic(fmt.Sprintf("proxy_set_header expects a name and a value at line %d", p.peek().Line))
+			}
+			loc.ProxySetHeaders = append(loc.ProxySetHeaders, Header{Name: strings.ToLower(args[0]), Value: args[1]})
+		case "proxy_hide_header":
+			loc.ProxyHideHeaders = append(loc.ProxyHideHeaders, strings.ToLower(value))
+		case "proxy_pass_header":
+			loc.ProxyPassHeaders = append(loc.ProxyPassHeaders, strings.ToLower(value))
+		case "proxy_set_host":
+			loc.ProxySetHost = value
+		case "proxy_redirect":
+			switch {
+			case len(args) == 1 && value == "off":
+				loc.ProxyRedirectOff = true
+			case len(args) == 1 && value == "default":
+				loc.ProxyRedirects = append(loc.ProxyRedirects, ProxyRedirect{Default: true})
+			case len(args) == 2:
+				loc.ProxyRedirects = append(loc.ProxyRedirects, ProxyRedirect{From: args[0], To: args[1]})
+			default:
+				panic(fmt.Sprintf("proxy_redirect expects default, off or a replaced prefix and its replacement at line %d", p.peek().Line))
+			}
+		case "proxy_follow_redirects":
+			loc.FollowRedirects = parseInt(key, value)
+		case "add_header":
+			if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "always") {
+				panic(fmt.Sprintf("add_header expects a name, a value and an optional always at line %d", p.peek().Line))
+			}
+			loc.AddHeaders = append(loc.AddHeaders, ResponseHeader{Name: strings.ToLower(args[0]), Value: args[1], Always: len(args) == 3})
+		case "rewrite":
+			if len(args) < 2 || len(args) > 3 || (len(args) == 3 && !slices.Contains(REWRITE_FLAGS, args[2])) {
+				panic(fmt.Sprintf("rewrite expects a regex, a replacement and an optional flag at line %d", p.peek().Line))
+			}
+
+			regex, err := regexp.Compile(args[0])
+			if err != nil {
+				panic(fmt.Sprintf("invalid rewrite regex %q at line %d: %v", args[0], p.peek().Line, err))
+			}
+
+			rewrite := Rewrite{Regex: regex, Replacement: args[1]}
+			if len(args) == 3 {
+				rewrite.Flag = args[2]
+			}
+			loc.Rewrites = append(loc.Rewrites, rewrite)
+		case "proxy_ssl_verify", "proxy_ssl_trusted_certificate", "proxy_ssl_server_name", "proxy_ssl_certificate", "proxy_ssl_certificate_key":
+			if loc.ProxySSL == nil {
+				loc.ProxySSL = &ProxySSL{}
+			}
+			applyProxySSLDirective(loc.ProxySSL, key, value)
+		case "proxy_cache":
+			if value != "off" {
+				loc.ProxyCache = value
+			}
+		case "proxy_cache_key":
+			loc.ProxyCacheKey = value
+		case "proxy_cache_valid":
+			loc.ProxyCacheValid = append(loc.ProxyCacheValid, parseCacheValid(args, p.peek().Line))
+		case "proxy_cache_lock":
+			loc.ProxyCacheLock = parseFlag(key, value)
+		case "proxy_cache_lock_timeout":
+			loc.ProxyCacheLockTimeout = parseDuration(key, value)
+		case "proxy_cache_use_stale":
+			for _, arg := range args {
+				if !slices.Contains(CACHE_USE_STALE_CONDITIONS, arg) {
+					panic(fmt.Sprintf("invalid proxy_cache_use_stale value %s at line %d", arg, p.peek().Line))
+				}
+			}
+			loc.ProxyCacheUseStale = args
+		case "proxy_cache_background_update":
+			loc.ProxyCacheBackgroundUpdate = parseFlag(key, value)
+		case "proxy_cache_purge":
+			loc.ProxyCachePurge = parseFlag(key, value)
+		case "fastcgi_pass":
+			loc.FastCGIPass = parseSocketAddress(key, value, p.peek().Line)
+		case "fastcgi_param":
+			loc.FastCGIParams = append(loc.FastCGIParams, parseCGIParam(key, args, p.peek().Line))
+		case "fastcgi_index":
+			loc.FastCGIIndex = value
+		case "mirror":
+			loc.Mirror = value
+		case "mirror_pass":
+			loc.MirrorPass = value
+			loc.MirrorTarget = parseProxyPass(key, value, p.peek().Line)
+		case "scgi_pass":
+			loc.SCGIPass = parseSocketAddress(key, value, p.peek().Line)
+		case "scgi_param":
+			loc.SCGIParams = append(loc.SCGIParams, parseCGIParam(key, args, p.peek().Line))
+		case "uwsgi_pass":
+			loc.UWSGIPass = parseSocketAddress(key, value, p.peek().Line)
+		case "uwsgi_param":
+			loc.UWSGIParams = append(loc.UWSGIParams, parseCGIParam(key, args, p.peek().Line))
+		case "cgi_root":
+			loc.CGIRoot = value
+		case "cgi_timeout":
+			loc.CGITimeout = parseDuration(key, value)
+		case "cgi_max_output_size":
+			loc.CGIMaxOutputSize = parseSize(key, value)
+		case "cache_admin":
+			loc.CacheAdmin = value
+		case "cache_admin_allow":
+			for _, arg := range args {
+				loc.CacheAdminAllow = append(loc.CacheAdminAllow, parsePrefix(key, arg))
+			}
+		case "cache_admin_user":
+			if len(args) != 2 {
+				panic(fmt.Sprintf("cache_admin_user expects a name and a password hash at line %d", p.peek().Line))
+			}
+			if loc.CacheAdminUsers == nil {
+				loc.CacheAdminUsers = map[string]string{}
+			}
+			loc.CacheAdminUsers[args[0]] = parsePasswordHash(key, args[1])
+		case "return":
+			loc.Return = parseReturn(args, p.peek().Line)
+		case "remove_header":
+			for _, arg := range args {
+				loc.RemoveHeaders = append(loc.RemoveHeaders, strings.ToLower(arg))
+			}
 		default:
 			panic(fmt.Sprintf("unknown location directive %s at line %d", key, p.peek().Line))
 		}
@@ -179,32 +606,270 @@ func (p *Parser) parseLocation() Location {
 	return loc
 }
 
-func (p *Parser) parseDirective() (string, string) {
+func applyProxySSLDirective(ssl *ProxySSL, key string, value string) {
+	switch key {
+	case "proxy_ssl_verify":
+		ssl.SkipVerify = !parseFlag(key, value)
+	case "proxy_ssl_trusted_certificate":
+		ssl.TrustedCertificate = value
+	case "proxy_ssl_server_name":
+		ssl.ServerName = value
+	case "proxy_ssl_certificate":
+		ssl.Certificate = value
+	case "proxy_ssl_certificate_key":
+		ssl.CertificateKey = value
+	}
+}
+
+// parseProxyPass validates a proxy_pass URL: http or https, a host, an
+// optional port and path, e.g. "http://[::1]:8000/api/". Sockets are
+// written "http://unix:/run/app.sock:/uri", the path ending at the colon.
+func parseProxyPass(key string, value string, line int) *ProxyTarget {
+	scheme, rest, found := strings.Cut(value, "://")
+	scheme = strings.ToLower(scheme)
+
+	if !found || (scheme != "http" && scheme != "https") {
+		panic(fmt.Sprintf("%s expects an http:// or https:// URL at line %d", key, line))
+	}
+
+	if strings.HasPrefix(rest, "unix:") {
+		socket, uri, _ := strings.Cut(strings.TrimPrefix(rest, "unix:"), ":")
+		if socket == "" {
+			panic(fmt.Sprintf("%s expects a socket path after unix: at line %d", key, line))
+		}
+		return &ProxyTarget{Scheme: scheme, Host: "unix:" + socket, Authority: "localhost", URI: uri}
+	}
+
+	u, err := url.Parse(value)
+	if err != nil {
+		panic(fmt.Sprintf("invalid %s %s at line %d: %v", key, value, line, err))
+	}
+
+	if u.Hostname() == "" || u.User != nil || u.RawQuery != "" || u.ForceQuery || u.Fragment != "" {
+		panic(fmt.Sprintf("invalid %s %s at line %d", key, value, line))
+	}
+
+	target := &ProxyTarget{
+		Scheme:    scheme,
+		Host:      u.Hostname(),
+		Port:      DEFAULT_PORTS[scheme],
+		Authority: u.Host,
+		URI:       u.EscapedPath(),
+	}
+
+	if u.Port() != "" {
+		port, err := strconv.Atoi(u.Port())
+		if err != nil || port < 1 || port > 65535 {
+			panic(fmt.Sprintf("invalid %s port %s at line %d", key, u.Port(), line))
+		}
+		target.Port = port
+		target.ExplicitPort = true
+	}
+
+	return target
+}
+
+// parseSocketAddress checks a "host:port" or "unix:/path" address
+func parseSocketAddress(key string, value string, line int) string {
+	if strings.HasPrefix(value, "unix:") {
+		if strings.TrimPrefix(value, "unix:") == "" {
+			panic(fmt.Sprintf("%s expects a socket path after unix: at line %d", key, line))
+		}
+		return value
+	}
+
+	host, port, err := net.SplitHostPort(value)
+	if err != nil || host == "" {
+		panic(fmt.Sprintf("%s expects host:port or unix:/path at line %d", key, line))
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		panic(fmt.Sprintf("invalid %s port %s at line %d", key, port, line))
+	}
+
+	return value
+}
+
+// parseCGIParam reads "<name> <value> [if_not_empty]"
+func parseCGIParam(key string, args []string, line int) CGIParam {
+	if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "if_not_empty") {
+		panic(fmt.Sprintf("%s expects a name, a value and optionally if_not_empty at line %d", key, line))
+	}
+
+	return CGIParam{Name: args[0], Value: args[1], IfNotEmpty: len(args) == 3}
+}
+
+// parseCacheValid reads "proxy_cache_valid [status ...|any] <duration>",
+// without status the rule applies to 200, 301 and 302
+func parseCacheValid(args []string, line int) CacheValid {
+	if len(args) == 0 {
+		panic(fmt.Sprintf("proxy_cache_valid expects a duration at line %d", line))
+	}
+
+	valid := CacheValid{Duration: parseDuration("proxy_cache_valid", args[len(args)-1])}
+
+	statuses := args[:len(args)-1]
+	if len(statuses) == 0 {
+		valid.Statuses = []int{200, 301, 302}
+	}
+
+	for _, status := range statuses {
+		if status == "any" {
+			valid.Statuses = nil
+			break
+		}
+
+		code := parseInt("proxy_cache_valid", status)
+		if code < 100 || code > 599 {
+			panic(fmt.Sprintf("invalid proxy_cache_valid status %d at line %d", code, line))
+		}
+		valid.Statuses = append(valid.Statuses, code)
+	}
+
+	return valid
+}
+
+// parseReturn reads "return <code> [text|url]" or "return <url>", a bare
+// URL redirecting with a 302
+func parseReturn(args []string, line int) *Return {
+	if len(args) == 1 && (strings.HasPrefix(args[0], "http://") || strings.HasPrefix(args[0], "https://")) {
+		return &Return{Code: 302, Text: args[0]}
+	}
+
+	if len(args) < 1 || len(args) > 2 {
+		panic(fmt.Sprintf("return expects a status code and an optional text or URL at line %d", line))
+	}
+
+	code := parseInt("return", args[0])
+	if code < 100 || code > 599 {
+		panic(fmt.Sprintf("invalid return status code %d at line %d", code, line))
+	}
+
+	ret := &Return{Code: code}
+	if len(args) == 2 {
+		// These responses cannot carry a body
+		if code < 200 || code == 204 || code == 304 {
+			panic(fmt.Sprintf("return %d cannot have a text at line %d", code, line))
+		}
+		ret.Text = args[1]
+	}
+
+	return ret
+}
+
+// A directive is its key followed by every value on the same line,
+// terminated by an optional semicolon or the end of the line.
+func (p *Parser) parseDirective() (string, []string) {
 	keyTok := p.consume()
 	if keyTok.Type != TokenIdentifier {
 		panic(fmt.Sprintf("expected directive at line %d", keyTok.Line))
 	}
 
-	if p.peek().Type == TokenSymbol && p.peek().Value == ";" {
-		// directive without value
-		p.consume()
-		return keyTok.Value, ""
+	args := []string{}
+
+	for {
+		tok := p.peek()
+
+		if tok.Type == TokenEOF || tok.Line != keyTok.Line {
+			break
+		}
+
+		if tok.Type == TokenSymbol {
+			// optionally consume trailing semicolon
+			if tok.Value == ";" {
+				p.consume()
+			}
+			break
+		}
+
+		args = append(args, p.consume().Value)
 	}
 
-	valTok := p.consume()
-	if valTok.Type != TokenIdentifier && valTok.Type != TokenNumber && valTok.Type != TokenString {
-		panic(fmt.Sprintf("expected directive value at line %d", valTok.Line))
+	return keyTok.Value, args
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
 	}
+	return args[0]
+}
 
-	// optionally consume trailing semicolon
-	if p.peek().Type == TokenSymbol && p.peek().Value == ";" {
-		p.consume()
+func parseInt(key string, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Sprintf("%s expects a number, got %q", key, value))
 	}
+	return n
+}
 
-	return keyTok.Value, valTok.Value
+// parsePasswordHash accepts the SHA-crypt hashes of openssl passwd -5 or -6
+func parsePasswordHash(key string, value string) string {
+	if !strings.HasPrefix(value, "$5$") && !strings.HasPrefix(value, "$6$") {
+		panic(fmt.Sprintf("%s expects a password hash made by openssl passwd -6, got %q", key, value))
+	}
+	return value
 }
 
-func (p *Parser) applyDirective(s *Server, key, value string) {
+func parseFlag(key string, value string) bool {
+	switch value {
+	case "on", "true", "yes":
+		return true
+	case "off", "false", "no":
+		return false
+	default:
+		panic(fmt.Sprintf("%s expects on or off, got %q", key, value))
+	}
+}
+
+// Prefixes accept CIDR notation or a single address
+func parsePrefix(key string, value string) netip.Prefix {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Masked()
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		panic(fmt.Sprintf("%s expects an address or CIDR, got %q", key, value))
+	}
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// Sizes are a number of bytes, optionally followed by k, m or g
+func parseSize(key string, value string) int64 {
+	multipliers := map[string]int64{"k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+	multiplier := int64(1)
+
+	if len(value) > 1 {
+		if m, ok := multipliers[strings.ToLower(value[len(value)-1:])]; ok {
+			multiplier = m
+			value = value[:len(value)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		panic(fmt.Sprintf("%s expects a size, got %q", key, value))
+	}
+	return n * multiplier
+}
+
+// Durations accept Go syntax ("500ms", "5s") or a bare number of seconds
+func parseDuration(key string, value string) time.Duration {
+	if isNumber(value) {
+		return time.Duration(parseInt(key, value)) * time.Second
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("%s expects a duration, got %q", key, value))
+	}
+	return d
+}
+
+func (p *Parser) applyDirective(s *Server, key string, args []string) {
+	value := firstArg(args)
+
 	switch key {
 	case "name":
 		s.Name = value
@@ -215,6 +880,15 @@ func (p *Parser) applyDirective(s *Server, key, value string) {
 		} else {
 			s.Listen.Port = port
 		}
+
+		for _, param := range args[1:] {
+			switch param {
+			case "proxy_protocol":
+				s.Listen.ProxyProtocol = true
+			default:
+				panic(fmt.Sprintf("unknown listen parameter %s", param))
+			}
+		}
 	case "ssl":
 		s.Listen.SSL = value == "true" || value == "yes"
 	case "hosts":
@@ -231,6 +905,26 @@ func (p *Parser) applyDirective(s *Server, key, value string) {
 			s.SSL = &SSLConfig{}
 		}
 		s.SSL.CertificateKey = value
+	case "set_real_ip_from":
+		s.RealIPFrom = append(s.RealIPFrom, parsePrefix(key, value))
+	case "real_ip_header":
+		s.RealIPHeader = strings.ToLower(value)
+	case "real_ip_recursive":
+		s.RealIPRecursive = parseFlag(key, value)
+	case "forward_proxy":
+		s.ForwardProxy = parseFlag(key, value)
+	case "forward_proxy_allow":
+		s.ForwardProxyAllow = append(s.ForwardProxyAllow, args...)
+	case "forward_proxy_deny":
+		s.ForwardProxyDeny = append(s.ForwardProxyDeny, args...)
+	case "forward_proxy_user":
+		if len(args) != 2 {
+			panic("forward_proxy_user expects a name and a password hash")
+		}
+		if s.ForwardProxyUsers == nil {
+			s.ForwardProxyUsers = map[string]string{}
+		}
+		s.ForwardProxyUsers[args[0]] = parsePasswordHash(key, args[1])
 	default:
 		panic(fmt.Sprintf("unknown server directive %s", key))
 	}
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProxyPass(t *testing.T) {
+	tests := []struct {
+		value string
+		want  ProxyTarget
+	}{
+		{"http://backend", ProxyTarget{Scheme: "http", Host: "backend", Port: 80, Authority: "backend"}},
+		{"https://example.com/api/", ProxyTarget{Scheme: "https", Host: "example.com", Port: 443, Authority: "example.com", URI: "/api/"}},
+		{"http://localhost:8000", ProxyTarget{Scheme: "http", Host: "localhost", Port: 8000, ExplicitPort: true, Authority: "localhost:8000"}},
+		{"http://[::1]:8000/v2/", ProxyTarget{Scheme: "http", Host: "::1", Port: 8000, ExplicitPort: true, Authority: "[::1]:8000", URI: "/v2/"}},
+		{"https://[2001:db8::1]", ProxyTarget{Scheme: "https", Host: "2001:db8::1", Port: 443, Authority: "[2001:db8::1]"}},
+		{"http://unix:/run/app.sock:/prefix/", ProxyTarget{Scheme: "http", Host: "unix:/run/app.sock", Authority: "localhost", URI: "/prefix/"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := parseProxyPass("proxy_pass", tt.value, 1); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseProxyPass(%q) = %+v, want %+v", tt.value, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProxyPassInvalid(t *testing.T) {
+	for _, value := range []string{
+		"localhost:8000",
+		"ftp://example.com",
+		"http://",
+		"http://example.com:99999",
+		"http://example.com:port",
+		"http://example.com/?q=1",
+		"http://user@example.com",
+		"http://unix:",
+	} {
+		t.Run(value, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("parseProxyPass(%q) did not fail", value)
+				}
+			}()
+			parseProxyPass("proxy_pass", value, 1)
+		})
+	}
+}
+
+func TestParseSocketAddress(t *testing.T) {
+	for _, value := range []string{"127.0.0.1:9000", "[::1]:9000", "php:9000", "unix:/run/php.sock"} {
+		if got := parseSocketAddress("fastcgi_pass", value, 1); got != value {
+			t.Errorf("parseSocketAddress(%q) = %q", value, got)
+		}
+	}
+
+	for _, value := range []string{"localhost", "unix:", ":9000", "localhost:0", "http://localhost:9000"} {
+		t.Run(value, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("parseSocketAddress(%q) did not fail", value)
+				}
+			}()
+			parseSocketAddress("fastcgi_pass", value, 1)
+		})
+	}
+}
+
+func TestParseReturn(t *testing.T) {
+	tests := []struct {
+		args []string
+		want Return
+	}{
+		{[]string{"https://example.com/"}, Return{Code: 302, Text: "https://example.com/"}},
+		{[]string{"301", "https://example.com$request_uri"}, Return{Code: 301, Text: "https://example.com$request_uri"}},
+		{[]string{"403"}, Return{Code: 403}},
+		{[]string{"200", "ok"}, Return{Code: 200, Text: "ok"}},
+		{[]string{"204"}, Return{Code: 204}},
+	}
+
+	for _, tt := range tests {
+		if got := parseReturn(tt.args, 1); *got != tt.want {
+			t.Errorf("parseReturn(%q) = %+v, want %+v", tt.args, *got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{
+		{},
+		{"/relative"},
+		{"99"},
+		{"600"},
+		{"200", "a", "b"},
+		{"101", "x"},
+		{"204", "x"},
+		{"304", "x"},
+	} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("parseReturn(%q) did not fail", args)
+				}
+			}()
+			parseReturn(args, 1)
+		})
+	}
+}
+
+func TestParseUpstreamServer(t *testing.T) {
+	tests := []struct {
+		params []string
+		want   UpstreamServer
+	}{
+		{nil, UpstreamServer{Address: "127.0.0.1:8000"}},
+		{[]string{"weight=3"}, UpstreamServer{Address: "127.0.0.1:8000", Weight: 3}},
+		{[]string{"weight=2", "down"}, UpstreamServer{Address: "127.0.0.1:8000", Weight: 2, Down: true}},
+	}
+
+	for _, tt := range tests {
+		if got := parseUpstreamServer("backend", "127.0.0.1:8000", tt.params); got != tt.want {
+			t.Errorf("parseUpstreamServer(%v) = %+v, want %+v", tt.params, got, tt.want)
+		}
+	}
+
+	for _, param := range []string{"weight=0", "weight=x", "backup"} {
+		t.Run(param, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("parseUpstreamServer(%q) did not fail", param)
+				}
+			}()
+			parseUpstreamServer("backend", "127.0.0.1:8000", []string{param})
+		})
+	}
+}
+
+func TestForwardProxyListen(t *testing.T) {
+	const dreamfile = `servers {
+  server {
+    name proxy
+    listen 3128
+    forward_proxy on
+  }
+
+  server {
+    name example.com
+    listen %d
+  }
+}
+`
+
+	cfg := ParseDreamFile(fmt.Sprintf(dreamfile, 8080))
+	if len(cfg.Servers) != 2 || !cfg.Servers[0].ForwardProxy {
+		t.Fatalf("unexpected servers %+v", cfg.Servers)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a forward proxy sharing its port to fail")
+		}
+	}()
+	ParseDreamFile(fmt.Sprintf(dreamfile, 3128))
+}
+
+func TestParseForwardProxyUser(t *testing.T) {
+	const hashed = "$6$q7Zc2LbXv4$A9KDKiONcPtYYGCyIIYZ85REMwLqhVDJdsn025YExsn.aTscaZyWNhmrwV2dEMtNO9spvNZP.hTtsiAD9Lo.U."
+
+	cfg := ParseDreamFile("servers {\n  server {\n    name proxy\n    listen 3128\n    forward_proxy_user ana " + hashed + "\n  }\n}\n")
+	if got := cfg.Servers[0].ForwardProxyUsers["ana"]; got != hashed {
+		t.Errorf("hash parsed as %q", got)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a plaintext password to fail")
+		}
+	}()
+	parsePasswordHash("forward_proxy_user", "s3cret")
+}
@@ -0,0 +1,308 @@
+package dream
+
+import (
+	"dreamproxy/cache"
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_PROXY_CACHE_KEY          = "$scheme$proxy_host$request_uri"
+	DEFAULT_PROXY_CACHE_LOCK_TIMEOUT = 5 * time.Second
+)
+
+// Values of the X-Cache-Status response header
+const (
+	CACHE_HIT         = "HIT"
+	CACHE_MISS        = "MISS"
+	CACHE_EXPIRED     = "EXPIRED"
+	CACHE_STALE       = "STALE"
+	CACHE_REVALIDATED = "REVALIDATED"
+	CACHE_UPDATING    = "UPDATING"
+	CACHE_BYPASS      = "BYPASS"
+)
+
+// Upstream statuses for which stale-if-error applies (RFC 5861, 4)
+var STALE_IF_ERROR_STATUSES = []http.StatusCode{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// Answered by the cache, not passed upstream, so full responses get stored
+var CONDITIONAL_HEADERS = []string{
+	"if-none-match",
+	"if-modified-since",
+	"if-match",
+	"if-unmodified-since",
+	"if-range",
+}
+
+// proxyCached answers GET and HEAD from the proxy_cache of the location,
+// going to the upstream for missing or expired responses
+func (session *ClientSession) proxyCached(req *http.HttpReq, location config.Location, target_uri string, target proxyTarget, req_log *logger.RequestLog) *http.HttpRes {
+	store := cache.Lookup(location.ProxyCache)
+
+	if store == nil {
+		return session.proxyRequest(req, location, target_uri, target, req_log)
+	}
+
+	vars := session.requestVariables(req, req_log.Request.ID)
+	vars["proxy_host"] = target.authority
+
+	key_template := location.ProxyCacheKey
+	if key_template == "" {
+		key_template = DEFAULT_PROXY_CACHE_KEY
+	}
+	key := interpolate(key_template, vars)
+
+	if req.Method == "PURGE" && location.ProxyCachePurge {
+		return session.purgeCacheKey(req, location, store, key)
+	}
+
+	if req.Method != "GET" && req.Method != "HEAD" {
+		res := session.proxyRequest(req, location, target_uri, target, req_log)
+
+		// Unsafe methods that went through make the stored response outdated
+		if res.Status < http.StatusBadRequest {
+			store.DeleteKey(key)
+		}
+
+		res.Headers["x-cache-status"] = CACHE_BYPASS
+		return res
+	}
+
+	entry := store.Get(key, req.Headers)
+	now := time.Now()
+
+	if entry != nil && entry.IsFresh(now) {
+		return session.cachedResponse(req, location, target, req_log, store, entry, CACHE_HIT)
+	}
+
+	serve_updating := entry != nil && canServeUpdating(location, entry, now)
+
+	if !location.ProxyCacheLock && !serve_updating {
+		return session.refreshCache(req, location, target_uri, target, req_log, store, key, entry)
+	}
+
+	unlock, done := store.Lock(key)
+
+	if unlock == nil {
+		// Another request is refreshing the key
+		if serve_updating {
+			return session.cachedResponse(req, location, target, req_log, store, entry, CACHE_UPDATING)
+		}
+
+		lock_timeout := location.ProxyCacheLockTimeout
+		if lock_timeout <= 0 {
+			lock_timeout = DEFAULT_PROXY_CACHE_LOCK_TIMEOUT
+		}
+
+		select {
+		case <-done:
+			if refreshed := store.Get(key, req.Headers); refreshed != nil && refreshed.IsFresh(time.Now()) {
+				return session.cachedResponse(req, location, target, req_log, store, refreshed, CACHE_HIT)
+			}
+		case <-time.After(lock_timeout):
+		}
+
+		// Still nothing to serve, go to the upstream as well
+		return session.refreshCache(req, location, target_uri, target, req_log, store, key, entry)
+	}
+
+	if serve_updating && location.ProxyCacheBackgroundUpdate {
+		// The refresh outlives this request, it gets its own copies
+		bg_session := *session
+		bg_req := *req
+		bg_req.Headers = maps.Clone(req.Headers)
+		bg_log := *req_log
+
+		go func() {
+			defer unlock()
+			bg_session.refreshCache(&bg_req, location, target_uri, target, &bg_log, store, key, entry)
+		}()
+
+		return session.cachedResponse(req, location, target, req_log, store, entry, CACHE_UPDATING)
+	}
+
+	defer unlock()
+
+	return session.refreshCache(req, location, target_uri, target, req_log, store, key, entry)
+}
+
+// refreshCache stores the upstream response, or revalidates the expired
+// entry, which may be served instead of an upstream failure
+func (session *ClientSession) refreshCache(req *http.HttpReq, location config.Location, target_uri string, target proxyTarget, req_log *logger.RequestLog, store *cache.Store, key string, entry *cache.Entry) *http.HttpRes {
+	// A HEAD is passed as a GET, the response to fill the cache with
+	upstream_req := *req
+	upstream_req.Method = "GET"
+	upstream_req.Headers = maps.Clone(req.Headers)
+
+	for _, name := range CONDITIONAL_HEADERS {
+		delete(upstream_req.Headers, name)
+	}
+
+	status := CACHE_MISS
+
+	if entry != nil {
+		status = CACHE_EXPIRED
+
+		if etag := entry.Headers["etag"]; etag != "" {
+			upstream_req.Headers["if-none-match"] = etag
+		}
+		if last_modified := entry.Headers["last-modified"]; last_modified != "" {
+			upstream_req.Headers["if-modified-since"] = last_modified
+		}
+	}
+
+	req_time := time.Now()
+	// Stored as sent by the upstream, the headers are prepared for each client
+	res, origins, err := session.fetchOrigin(&upstream_req, location, target_uri, target, req_log)
+	res_time := time.Now()
+
+	if entry != nil && canServeStale(location, entry, res, err, res_time) {
+		return session.cachedResponse(req, location, target, req_log, store, entry, CACHE_STALE)
+	}
+
+	if err != nil {
+		return upstreamErrorRes(err)
+	}
+
+	if entry != nil && res.Status == http.StatusNotModified {
+		if revalidated := entry.Revalidated(req.Headers, res, req_time, res_time, location.ProxyCacheValid); revalidated != nil {
+			revalidated.Origins = origins
+			storeEntry(store, revalidated)
+			return session.cachedResponse(req, location, target, req_log, store, revalidated, CACHE_REVALIDATED)
+		}
+
+		store.Delete(entry)
+		return session.cachedResponse(req, location, target, req_log, store, entry, CACHE_REVALIDATED)
+	}
+
+	if fresh := cache.NewEntry(key, req.Headers, res, req_time, res_time, location.ProxyCacheValid); fresh != nil {
+		fresh.Origins = origins
+		storeEntry(store, fresh)
+	}
+
+	session.clientUpstreamRes(res, req, location, target, origins, req_log)
+	res.Headers["x-cache-status"] = status
+	delete(res.Headers, "cache-tag")
+
+	if req.Method == "HEAD" {
+		res.Body = nil
+	}
+
+	return res
+}
+
+// canServeUpdating tells whether the entry may be served while another
+// request refreshes it
+func canServeUpdating(location config.Location, entry *cache.Entry, now time.Time) bool {
+	if entry.MustRevalidate {
+		return false
+	}
+
+	return slices.Contains(location.ProxyCacheUseStale, "updating") ||
+		(entry.StaleWhileRevalidate > 0 && entry.Staleness(now) <= entry.StaleWhileRevalidate)
+}
+
+// canServeStale tells whether the entry may replace the upstream outcome
+func canServeStale(location config.Location, entry *cache.Entry, res *http.HttpRes, err error, now time.Time) bool {
+	if entry.MustRevalidate {
+		return false
+	}
+
+	conditions := location.ProxyCacheUseStale
+	condition := ""
+
+	switch {
+	case err != nil && http.IsTimeout(err):
+		condition = "timeout"
+	case err != nil:
+		condition = "error"
+	default:
+		condition = fmt.Sprintf("http_%d", res.Status)
+	}
+
+	if slices.Contains(conditions, condition) {
+		return true
+	}
+
+	if err == nil && res.Status >= http.StatusInternalServerError && slices.Contains(conditions, "http_5xx") {
+		return true
+	}
+
+	// stale-if-error covers errors and the usual gateway statuses
+	upstream_failed := err != nil || slices.Contains(STALE_IF_ERROR_STATUSES, res.Status)
+
+	return upstream_failed && entry.StaleIfError > 0 && entry.Staleness(now) <= entry.StaleIfError
+}
+
+// cachedResponse serves a stored response, or a 304
+func (session *ClientSession) cachedResponse(req *http.HttpReq, location config.Location, target proxyTarget, req_log *logger.RequestLog, store *cache.Store, entry *cache.Entry, status string) *http.HttpRes {
+	store.RecordHit(entry)
+
+	res := entry.Response(time.Now())
+	session.clientUpstreamRes(res, req, location, target, entry.Origins, req_log)
+	res.Headers["x-cache-status"] = status
+
+	if isNotModified(req.Headers, res.Headers) {
+		res.Status = http.StatusNotModified
+		res.Body = nil
+		delete(res.Headers, "content-length")
+		delete(res.Headers, "transfer-encoding")
+		return res
+	}
+
+	if req.Method == "HEAD" {
+		res.Body = nil
+	}
+
+	return res
+}
+
+// isNotModified evaluates If-None-Match, or If-Modified-Since without it,
+// against a stored response (RFC 9110, 13.2.2)
+func isNotModified(req_headers map[string]string, res_headers map[string]string) bool {
+	if if_none_match := req_headers["if-none-match"]; if_none_match != "" {
+		etag := weakETag(res_headers["etag"])
+		if etag == "" {
+			return false
+		}
+
+		for _, candidate := range strings.Split(if_none_match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakETag(candidate) == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := cache.ParseDate(req_headers["if-modified-since"])
+	if err != nil {
+		return false
+	}
+
+	last_modified, err := cache.ParseDate(res_headers["last-modified"])
+	return err == nil && !last_modified.After(since)
+}
+
+// If-None-Match uses the weak comparison, W/"x" matches "x"
+func weakETag(etag string) string {
+	return strings.TrimPrefix(etag, "W/")
+}
+
+func storeEntry(store *cache.Store, entry *cache.Entry) {
+	if err := store.Put(entry); err != nil {
+		log := logger.NewRequestLog(logger.DREAM_SERVER, logger.WARN, logger.CACHE_ERROR, fmt.Sprintf("cache %s: %s", store.Name, err))
+		fmt.Println(log.ToText())
+	}
+}
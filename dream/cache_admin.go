@@ -0,0 +1,171 @@
+package dream
+
+import (
+	"dreamproxy/cache"
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"encoding/json"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CACHE_ADMIN_REALM = "dreamproxy cache"
+
+// Clients allowed to purge and use the cache admin without cache_admin_allow
+var DEFAULT_CACHE_ADMIN_ALLOW = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+type cacheEntryInfo struct {
+	Key    string            `json:"key"`
+	Vary   map[string]string `json:"vary,omitempty"`
+	Status int               `json:"status"`
+	Size   int64             `json:"size"`
+	Hits   int64             `json:"hits"`
+	Tags   []string          `json:"tags,omitempty"`
+
+	// In seconds, TTL is negative once expired
+	Age int64 `json:"age"`
+	TTL int64 `json:"ttl"`
+}
+
+// handleCacheAdmin lists the entries of the cache_admin cache on GET, and
+// drops them on PURGE or DELETE
+func (session *ClientSession) handleCacheAdmin(req *http.HttpReq, location config.Location, args string) *http.HttpRes {
+	if res := session.checkCacheAdmin(req, location); res != nil {
+		return res
+	}
+
+	store := cache.Lookup(location.CacheAdmin)
+	if store == nil {
+		return http.NewErrorRes(http.StatusNotFound)
+	}
+
+	query, err := url.ParseQuery(args)
+	if err != nil {
+		return http.NewErrorRes(http.StatusBadRequest)
+	}
+
+	match, selected, valid := cacheSelector(query)
+	if !valid {
+		return http.NewErrorRes(http.StatusBadRequest)
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		now := time.Now()
+		used, max_size := store.Size()
+		entries := []cacheEntryInfo{}
+
+		for _, entry := range store.Entries() {
+			if !match(&entry) {
+				continue
+			}
+
+			entries = append(entries, cacheEntryInfo{
+				Key:    entry.Key,
+				Vary:   entry.Vary,
+				Status: int(entry.Status),
+				Size:   entry.Size(),
+				Hits:   entry.Hits,
+				Tags:   entry.Tags,
+				Age:    int64(entry.Age(now) / time.Second),
+				TTL:    int64((entry.Freshness - entry.Age(now)) / time.Second),
+			})
+		}
+
+		return newJSONRes(req, map[string]any{
+			"cache":    store.Name,
+			"size":     used,
+			"max_size": max_size,
+			"entries":  entries,
+		})
+	case "PURGE", "DELETE":
+		if !selected {
+			return http.NewErrorRes(http.StatusBadRequest)
+		}
+
+		return newJSONRes(req, map[string]any{"purged": store.Purge(match)})
+	default:
+		return http.NewErrorRes(http.StatusMethodNotAllowed)
+	}
+}
+
+// purgeCacheKey drops every variant of the key on a proxy_cache_purge PURGE
+func (session *ClientSession) purgeCacheKey(req *http.HttpReq, location config.Location, store *cache.Store, key string) *http.HttpRes {
+	if res := session.checkCacheAdmin(req, location); res != nil {
+		return res
+	}
+
+	return newJSONRes(req, map[string]any{"purged": store.DeleteKey(key)})
+}
+
+// checkCacheAdmin returns nil for clients allowed by cache_admin_allow and
+// cache_admin_user
+func (session *ClientSession) checkCacheAdmin(req *http.HttpReq, location config.Location) *http.HttpRes {
+	allowed := location.CacheAdminAllow
+	if len(allowed) == 0 {
+		allowed = DEFAULT_CACHE_ADMIN_ALLOW
+	}
+
+	client_ip, err := netip.ParseAddr(session.ClientIP)
+	if err != nil || !slices.ContainsFunc(allowed, func(prefix netip.Prefix) bool { return prefix.Contains(client_ip.Unmap()) }) {
+		return http.NewErrorRes(http.StatusForbidden)
+	}
+
+	if !checkProxyAuth(req.Headers["authorization"], location.CacheAdminUsers) {
+		res := http.NewErrorRes(http.StatusUnauthorized)
+		res.Headers["www-authenticate"] = "Basic realm=\"" + CACHE_ADMIN_REALM + "\""
+		return res
+	}
+
+	return nil
+}
+
+// cacheSelector matches the entries selected by the key, prefix and tag
+// query parameters. Empty values are invalid, "?prefix=" would match all.
+func cacheSelector(query url.Values) (match func(entry *cache.Entry) bool, selected bool, valid bool) {
+	for _, name := range []string{"key", "prefix", "tag"} {
+		if query.Has(name) && query.Get(name) == "" {
+			return nil, false, false
+		}
+	}
+
+	selected = query.Has("key") || query.Has("prefix") || query.Has("tag")
+
+	match = func(entry *cache.Entry) bool {
+		if query.Has("key") && entry.Key != query.Get("key") {
+			return false
+		}
+		if query.Has("prefix") && !strings.HasPrefix(entry.Key, query.Get("prefix")) {
+			return false
+		}
+		if query.Has("tag") && !slices.Contains(entry.Tags, query.Get("tag")) {
+			return false
+		}
+		return true
+	}
+
+	return match, selected, true
+}
+
+func newJSONRes(req *http.HttpReq, value any) *http.HttpRes {
+	body, _ := json.Marshal(value)
+	body = append(body, '\n')
+
+	res := http.CreateHttpRes()
+	res.Status = http.StatusOK
+	res.Headers["content-type"] = "application/json"
+	res.Headers["content-length"] = strconv.Itoa(len(body))
+
+	if req.Method != "HEAD" {
+		res.Body = body
+	}
+
+	return res
+}
@@ -0,0 +1,50 @@
+package dream
+
+import (
+	"dreamproxy/cache"
+	"net/url"
+	"testing"
+)
+
+func TestCacheSelector(t *testing.T) {
+	entry := &cache.Entry{Key: "httpdjango/blog/post-1", Tags: []string{"blog", "post-1"}}
+
+	tests := []struct {
+		query    string
+		valid    bool
+		selected bool
+		want     bool
+	}{
+		{"", true, false, true},
+		{"key=httpdjango/blog/post-1", true, true, true},
+		{"key=httpdjango/blog/", true, true, false},
+		{"prefix=httpdjango/blog/", true, true, true},
+		{"prefix=httpdjango/shop/", true, true, false},
+		{"tag=post-1", true, true, true},
+		{"tag=post", true, true, false},
+		{"prefix=httpdjango/&tag=blog", true, true, true},
+		{"prefix=", false, false, false},
+		{"key=&tag=blog", false, false, false},
+		{"tag", false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			match, selected, valid := cacheSelector(query)
+
+			if valid != tt.valid {
+				t.Fatalf("valid = %v, want %v", valid, tt.valid)
+			}
+			if !valid {
+				return
+			}
+			if selected != tt.selected {
+				t.Errorf("selected = %v, want %v", selected, tt.selected)
+			}
+			if got := match(entry); got != tt.want {
+				t.Errorf("match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package dream
+
+import (
+	"dreamproxy/cache"
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"errors"
+	"maps"
+	"net"
+	nethttp "net/http"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCanServeStale(t *testing.T) {
+	now := time.Now()
+	expired := &cache.Entry{ResponseTime: now.Add(-time.Minute), Freshness: 30 * time.Second}
+	stale_if_error := &cache.Entry{ResponseTime: now.Add(-time.Minute), Freshness: 30 * time.Second, StaleIfError: time.Minute}
+	must_revalidate := &cache.Entry{ResponseTime: now.Add(-time.Minute), Freshness: 30 * time.Second, MustRevalidate: true}
+
+	status := func(code http.StatusCode) *http.HttpRes {
+		res := http.CreateHttpRes()
+		res.Status = code
+		return res
+	}
+
+	tests := []struct {
+		name     string
+		entry    *cache.Entry
+		useStale []string
+		res      *http.HttpRes
+		err      error
+		want     bool
+	}{
+		{"Error allowed", expired, []string{"error"}, nil, errors.New("refused"), true},
+		{"Timeout not allowed", expired, []string{"error"}, nil, os.ErrDeadlineExceeded, false},
+		{"Timeout allowed", expired, []string{"timeout"}, nil, os.ErrDeadlineExceeded, true},
+		{"http_5xx", expired, []string{"http_5xx"}, status(503), nil, true},
+		{"Exact status", expired, []string{"http_404"}, status(404), nil, true},
+		{"Success", expired, []string{"http_5xx", "error"}, status(200), nil, false},
+		{"stale-if-error", stale_if_error, nil, status(502), nil, true},
+		{"stale-if-error on 404", stale_if_error, nil, status(404), nil, false},
+		{"must-revalidate", must_revalidate, []string{"error"}, nil, errors.New("refused"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			location := config.Location{ProxyCacheUseStale: tt.useStale}
+			if got := canServeStale(location, tt.entry, tt.res, tt.err, now); got != tt.want {
+				t.Errorf("canServeStale() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyCached(t *testing.T) {
+	cache.Init([]config.Cache{{Name: "proxy_cached_test"}})
+
+	var origin string
+	requests := map[string]int{}
+	date := time.Now().Add(-10 * time.Second).UTC().Format(nethttp.TimeFormat)
+
+	host, port := startOrigin(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		requests[r.Method+" "+r.URL.Path+" "+r.Header.Get("If-None-Match")]++
+
+		switch {
+		case r.URL.Path == "/page" && r.Header.Get("If-None-Match") == `"v1"`:
+			// A length on a 304, as some servers send
+			conn, buf, _ := w.(nethttp.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nCache-Control: max-age=0\r\nContent-Length: 5\r\nConnection: close\r\n\r\n")
+			buf.Flush()
+			conn.Close()
+		case r.URL.Path == "/page":
+			w.Header().Set("Date", date)
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Cache-Control", "max-age=0")
+			w.Write([]byte("hello"))
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Location", "http://"+origin+"/dest")
+			w.WriteHeader(nethttp.StatusMovedPermanently)
+		}
+	})
+	origin = net.JoinHostPort(host, strconv.Itoa(port))
+
+	location := config.Location{
+		ProxyCache:     "proxy_cached_test",
+		ReadTimeout:    2 * time.Second,
+		ProxyRedirects: []config.ProxyRedirect{{From: "http://" + origin + "/", To: "https://$host/"}},
+	}
+	target := proxyTarget{host: host, port: port, authority: origin}
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	session := ClientSession{RemoteAddress: "192.0.2.1", ClientIP: "192.0.2.1", Connection: conn}
+
+	steps := []struct {
+		name        string
+		method      string
+		path        string
+		headers     map[string]string
+		status      http.StatusCode
+		cacheStatus string
+		body        string
+		location    string
+	}{
+		{"Miss", "GET", "/page", nil, http.StatusOK, CACHE_MISS, "hello", ""},
+		{"Client conditional after revalidation", "GET", "/page", map[string]string{"if-none-match": `"v1"`}, http.StatusNotModified, CACHE_REVALIDATED, "", ""},
+		{"Revalidated", "GET", "/page", nil, http.StatusOK, CACHE_REVALIDATED, "hello", ""},
+		{"Redirect for a first host", "GET", "/redirect", map[string]string{"host": "a.example"}, http.StatusMovedPermanently, CACHE_MISS, "", "https://a.example/dest"},
+		{"Redirect rewritten for another host", "GET", "/redirect", map[string]string{"host": "b.example"}, http.StatusMovedPermanently, CACHE_HIT, "", "https://b.example/dest"},
+		{"Bypass", "POST", "/redirect", nil, http.StatusMovedPermanently, CACHE_BYPASS, "", "https://example.com/dest"},
+		{"Bypass dropped the entry", "GET", "/redirect", nil, http.StatusMovedPermanently, CACHE_MISS, "", "https://example.com/dest"},
+	}
+
+	for _, step := range steps {
+		req := &http.HttpReq{Method: step.method, Scheme: "http", Target: step.path, Version: "1.1", Headers: map[string]string{"host": "example.com"}}
+		maps.Copy(req.Headers, step.headers)
+		if step.method == "POST" {
+			req.Headers["content-length"] = "0"
+		}
+
+		req_log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
+
+		start := time.Now()
+		res := session.proxyCached(req, location, step.path, target, &req_log)
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: answered after %s", step.name, elapsed)
+		}
+		if res.Status != step.status || res.Headers["x-cache-status"] != step.cacheStatus {
+			t.Fatalf("%s: got %d %s, want %d %s", step.name, res.Status, res.Headers["x-cache-status"], step.status, step.cacheStatus)
+		}
+		if step.body != "" && string(res.Body) != step.body {
+			t.Errorf("%s: body = %q", step.name, res.Body)
+		}
+		if res.Headers["location"] != step.location {
+			t.Errorf("%s: location = %q, want %q", step.name, res.Headers["location"], step.location)
+		}
+		if _, ok := res.Headers["date"]; ok {
+			t.Errorf("%s: the upstream date was passed", step.name)
+		}
+	}
+
+	if n := requests[`GET /page "v1"`]; n != 2 {
+		t.Errorf("expected 2 revalidations, got %d", n)
+	}
+
+	// Stored with the date of the upstream, which the age accounts for
+	entry := cache.Lookup("proxy_cached_test").Get("http"+origin+"/page", map[string]string{})
+	if entry == nil || entry.Headers["date"] != date {
+		t.Fatalf("expected the entry to keep the upstream date, got %+v", entry)
+	}
+	if age := entry.Age(time.Now()); age < 10*time.Second {
+		t.Errorf("age = %s, expected at least 10s", age)
+	}
+}
@@ -0,0 +1,292 @@
+package dream
+
+import (
+	"bytes"
+	"context"
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CGI_SERVER_SOFTWARE = "dreamserver/0.0.1"
+
+	DEFAULT_CGI_TIMEOUT         = 30 * time.Second
+	DEFAULT_CGI_MAX_OUTPUT_SIZE = 10 << 20
+
+	// Logged stderr of the scripts
+	MAX_CGI_STDERR_SIZE = 4 << 10
+
+	// Wait for children holding the output once a script exited
+	CGI_WAIT_DELAY = 250 * time.Millisecond
+)
+
+var errCGIOutputTooLarge = errors.New("cgi: output exceeds cgi_max_output_size")
+
+// handleCGI runs the script of cgi_root named by the path
+func (session *ClientSession) handleCGI(req *http.HttpReq, location config.Location, req_path string, args string, req_log *logger.RequestLog) *http.HttpRes {
+	script, script_name, path_info, status := resolveCGIScript(location.CGIRoot, location.Path, req_path)
+
+	if status != 0 {
+		return http.NewErrorRes(status)
+	}
+
+	vars := session.requestVariables(req, req_log.Request.ID)
+	env := session.cgiVariables(req, location, req_path, args, "", vars)
+
+	env["SCRIPT_NAME"] = script_name
+	env["SCRIPT_FILENAME"] = script
+	if path_info != "" {
+		env["PATH_INFO"] = path_info
+	}
+
+	timeout := location.CGITimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_CGI_TIMEOUT
+	}
+
+	max_output := location.CGIMaxOutputSize
+	if max_output <= 0 {
+		max_output = DEFAULT_CGI_MAX_OUTPUT_SIZE
+	}
+
+	req_log.Trace.UpstreamIP = script
+	start := time.Now()
+
+	res, stderr, err := runCGI(script, env, req.Body, timeout, max_output)
+
+	req_log.Trace.UpstreamLatencyMS = time.Since(start).Milliseconds()
+
+	if len(stderr) > 0 {
+		logUpstreamFailure(req, req_log, nil, fmt.Errorf("cgi stderr: %s", strings.TrimSpace(string(stderr))), false)
+	}
+
+	if err != nil {
+		logUpstreamFailure(req, req_log, nil, err, false)
+		return upstreamErrorRes(err)
+	}
+
+	res.SetReverseProxyHeaders()
+
+	if req.Method == "HEAD" {
+		res.Body = nil
+	}
+
+	return res
+}
+
+// resolveCGIScript walks the path under the location prefix down root
+// until it reaches a file, the rest being the PATH_INFO
+func resolveCGIScript(root string, prefix string, req_path string) (script string, script_name string, path_info string, status http.StatusCode) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(req_path, prefix), "/"), "/")
+	dir := root
+
+	for i, segment := range segments {
+		// The path is clean, there is no ".." to escape root with
+		if segment == "" {
+			break
+		}
+
+		file := filepath.Join(dir, segment)
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return "", "", "", http.StatusNotFound
+		}
+
+		if info.IsDir() {
+			dir = file
+			continue
+		}
+
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0o111 == 0 {
+			return "", "", "", http.StatusForbidden
+		}
+
+		script_name = strings.TrimSuffix(prefix, "/") + "/" + strings.Join(segments[:i+1], "/")
+
+		if rest := segments[i+1:]; len(rest) > 0 {
+			path_info = "/" + strings.Join(rest, "/")
+			if strings.HasSuffix(req_path, "/") {
+				path_info += "/"
+			}
+		}
+
+		return file, script_name, path_info, 0
+	}
+
+	return "", "", "", http.StatusNotFound
+}
+
+// runCGI executes script with the body on its stdin, returning its
+// response and stderr
+func runCGI(script string, env map[string]string, body []byte, timeout time.Duration, max_output int64) (*http.HttpRes, []byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = cgiEnviron(env)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.WaitDelay = CGI_WAIT_DELAY
+
+	// An output too large kills the script, stderr is only truncated
+	stdout := &limitedBuffer{max: max_output, on_exceeded: cancel}
+	stderr := &limitedBuffer{max: MAX_CGI_STDERR_SIZE}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+
+	switch {
+	case stdout.exceeded:
+		return nil, stderr.Bytes(), errCGIOutputTooLarge
+	case ctx.Err() != nil:
+		// A net.Error timeout, answered with 504
+		return nil, stderr.Bytes(), fmt.Errorf("cgi: %s: %w", script, ctx.Err())
+	case err != nil:
+		return nil, stderr.Bytes(), fmt.Errorf("cgi: %s: %w", script, err)
+	}
+
+	res, err := http.ParseCGIResponse(stdout.Bytes())
+
+	return res, stderr.Bytes(), err
+}
+
+// cgiEnviron adds the PATH of the server, for the interpreters of scripts
+func cgiEnviron(env map[string]string) []string {
+	environ := make([]string, 0, len(env)+1)
+
+	for name, value := range env {
+		environ = append(environ, name+"="+value)
+	}
+
+	if _, ok := env["PATH"]; !ok {
+		environ = append(environ, "PATH="+os.Getenv("PATH"))
+	}
+
+	sort.Strings(environ)
+
+	return environ
+}
+
+// limitedBuffer keeps at most max bytes, then fails after calling
+// on_exceeded, or drops the rest without it. Not embedding the buffer keeps
+// io.Copy from using its ReadFrom.
+type limitedBuffer struct {
+	buf         bytes.Buffer
+	max         int64
+	exceeded    bool
+	on_exceeded func()
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - int64(b.buf.Len())
+
+	if int64(len(p)) <= room {
+		return b.buf.Write(p)
+	}
+
+	b.exceeded = true
+
+	if b.on_exceeded != nil {
+		b.on_exceeded()
+		return 0, errCGIOutputTooLarge
+	}
+
+	b.buf.Write(p[:max(room, 0)])
+
+	return len(p), nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// cgiVariables builds the meta-variables of RFC 3875 (4.1), adding the
+// script name and document root to vars for the params
+func (session *ClientSession) cgiVariables(req *http.HttpReq, location config.Location, req_path string, args string, index string, vars map[string]string) map[string]string {
+	script_name := req_path
+	if strings.HasSuffix(script_name, "/") && index != "" {
+		script_name += index
+	}
+
+	server_addr, server_port := "", ""
+	if host, port, err := net.SplitHostPort(session.Connection.LocalAddr().String()); err == nil {
+		server_addr, server_port = host, port
+	}
+
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   CGI_SERVER_SOFTWARE,
+		"SERVER_PROTOCOL":   "HTTP/" + req.Version,
+		"SERVER_NAME":       vars["host"],
+		"SERVER_ADDR":       server_addr,
+		"SERVER_PORT":       server_port,
+		"REMOTE_ADDR":       session.ClientIP,
+		"REMOTE_PORT":       session.RemotePort,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.Target,
+		"DOCUMENT_URI":      req_path,
+		"QUERY_STRING":      args,
+		"SCRIPT_NAME":       script_name,
+		"DOCUMENT_ROOT":     location.Root,
+	}
+
+	if location.Root != "" {
+		env["SCRIPT_FILENAME"] = path.Join(location.Root, script_name)
+	}
+
+	if req.Scheme == "https" {
+		env["HTTPS"] = "on"
+	}
+
+	if len(req.Body) > 0 || req.Headers["content-length"] != "" {
+		env["CONTENT_LENGTH"] = fmt.Sprint(len(req.Body))
+	}
+
+	if content_type := req.Headers["content-type"]; content_type != "" {
+		env["CONTENT_TYPE"] = content_type
+	}
+
+	for name, value := range req.Headers {
+		// HTTP_PROXY would be taken as the outgoing proxy (httpoxy)
+		if name == "content-type" || name == "content-length" || name == "proxy" {
+			continue
+		}
+
+		env["HTTP_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))] = value
+	}
+
+	vars["document_root"] = location.Root
+	vars["document_uri"] = req_path
+	vars["script_name"] = script_name
+
+	return env
+}
+
+// applyCGIParams sets the params over env, empty values remove variables
+func applyCGIParams(env map[string]string, params []config.CGIParam, vars map[string]string) {
+	for _, param := range params {
+		value := interpolate(param.Value, vars)
+
+		if value == "" {
+			if !param.IfNotEmpty {
+				delete(env, param.Name)
+			}
+			continue
+		}
+
+		env[param.Name] = value
+	}
+}
@@ -0,0 +1,102 @@
+package dream
+
+import (
+	"dreamproxy/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, path string, content string, mode os.FileMode) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveCGIScript(t *testing.T) {
+	root := t.TempDir()
+	writeScript(t, filepath.Join(root, "tools", "report.sh"), "", 0o755)
+	writeScript(t, filepath.Join(root, "data.txt"), "", 0o644)
+
+	tests := []struct {
+		path       string
+		script     string
+		scriptName string
+		pathInfo   string
+		status     http.StatusCode
+	}{
+		{path: "/cgi-bin/tools/report.sh", script: "tools/report.sh", scriptName: "/cgi-bin/tools/report.sh"},
+		{path: "/cgi-bin/tools/report.sh/2024/june/", script: "tools/report.sh", scriptName: "/cgi-bin/tools/report.sh", pathInfo: "/2024/june/"},
+		{path: "/cgi-bin/tools/", status: http.StatusNotFound},
+		{path: "/cgi-bin/missing.sh", status: http.StatusNotFound},
+		{path: "/cgi-bin/data.txt", status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			script, script_name, path_info, status := resolveCGIScript(root, "/cgi-bin/", tt.path)
+
+			if status != tt.status {
+				t.Fatalf("status = %d, want %d", status, tt.status)
+			}
+
+			if tt.status != 0 {
+				return
+			}
+
+			if script != filepath.Join(root, tt.script) || script_name != tt.scriptName || path_info != tt.pathInfo {
+				t.Errorf("got %q %q %q", script, script_name, path_info)
+			}
+		})
+	}
+}
+
+func TestRunCGI(t *testing.T) {
+	root := t.TempDir()
+
+	echo := filepath.Join(root, "echo.sh")
+	writeScript(t, echo, `printf 'Status: 201 Created\r\nContent-Type: text/plain\r\n\r\n'
+echo "$REQUEST_METHOD $QUERY_STRING $HTTP_X_TOKEN"
+cat
+echo oops >&2
+`, 0o755)
+
+	res, stderr, err := runCGI(echo, map[string]string{
+		"REQUEST_METHOD": "POST",
+		"QUERY_STRING":   "a=1",
+		"HTTP_X_TOKEN":   "t0k",
+	}, []byte("hello"), time.Second, 1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Status != http.StatusCreated || string(res.Body) != "POST a=1 t0k\nhello" || strings.TrimSpace(string(stderr)) != "oops" {
+		t.Errorf("got %d %q, stderr %q", res.Status, res.Body, stderr)
+	}
+
+	slow := filepath.Join(root, "slow.sh")
+	writeScript(t, slow, "sleep 5\n", 0o755)
+
+	start := time.Now()
+	if _, _, err := runCGI(slow, nil, nil, 100*time.Millisecond, 1024); !http.IsTimeout(err) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("timed out script ran for %s", elapsed)
+	}
+
+	large := filepath.Join(root, "large.sh")
+	writeScript(t, large, "printf 'Content-Type: text/plain\\n\\n'\nwhile true; do echo xxxxxxxxxxxxxxxx; done\n", 0o755)
+
+	if _, _, err := runCGI(large, nil, nil, 5*time.Second, 1024); err != errCGIOutputTooLarge {
+		t.Errorf("expected errCGIOutputTooLarge, got %v", err)
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"path"
 	"path/filepath"
 	"slices"
-	"strconv"
 	"strings"
 	"time"
 
@@ -24,23 +23,35 @@ type ClientSession struct {
 	RemoteAddress string
 	RemotePort    string
 	Connection    net.Conn
+
+	// Client address announced by a PROXY protocol header, if any
+	ProxyProtocolAddress string
+	ProxyProtocolPort    string
+
+	// Effective client address of the current request, differs from
+	// RemoteAddress when a trusted proxy forwarded the request
+	ClientIP string
+
+	// Upstream connection of an upgraded request (e.g. WebSocket), spliced
+	// with Connection once the 101 response is written
+	Tunnel            net.Conn
+	TunnelIdleTimeout time.Duration
 }
 
 func NewClientSession(connection net.Conn) ClientSession {
 	remote_addr := connection.RemoteAddr().String()
 	remote_port := ""
 
-	if strings.Contains(remote_addr, ":") {
-		split := strings.Split(remote_addr, ":")
-
-		remote_addr = split[0]
-		remote_port = split[1]
+	if host, port, err := net.SplitHostPort(remote_addr); err == nil {
+		remote_addr = host
+		remote_port = port
 	}
 
 	return ClientSession{
 		RemoteAddress: remote_addr,
 		RemotePort:    remote_port,
 		Connection:    connection,
+		ClientIP:      remote_addr,
 	}
 }
 
@@ -73,8 +84,10 @@ func (session *ClientSession) HandleConnection(server_configs []config.Server) {
 
 		//------------- Request has been successfully parsed by now
 
-		req.Headers["x-forwarded-for"] = connection.RemoteAddr().String()
-		res, err := HandleRequest(req, server_configs)
+		log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
+		log.Request.ID = uuid.New().String()
+
+		res, err := session.HandleRequest(req, server_configs, &log)
 
 		if err != nil {
 			res := http.NewBadRequestRes(*req, connection.RemoteAddr().String(), err)
@@ -91,12 +104,10 @@ func (session *ClientSession) HandleConnection(server_configs []config.Server) {
 		latency := time.Since(req_start)
 		connection.Write(res_bytes)
 
-		log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
-		log.Request.ID = uuid.New().String()
 		log.Request.Method = req.Method
 		log.Request.Path = req.Target
 		log.Request.Host = req.Headers["host"]
-		log.Request.ClientIP = connection.RemoteAddr().String()
+		log.Request.ClientIP = session.ClientIP
 		log.Response.StatusCode = int(res.Status)
 		log.Response.BytesSent = int64(len(res.Body))
 		log.Response.LatencyMS = latency.Milliseconds()
@@ -105,6 +116,12 @@ func (session *ClientSession) HandleConnection(server_configs []config.Server) {
 		// Create a log handler
 		fmt.Println(log.ToText())
 
+		// The connection now belongs to the upgraded protocol
+		if session.Tunnel != nil {
+			session.spliceTunnel(req, &log)
+			return
+		}
+
 		// Check keep-alive
 		if strings.ToLower(res.Headers["connection"]) == "close" {
 			return
@@ -112,7 +129,9 @@ func (session *ClientSession) HandleConnection(server_configs []config.Server) {
 	}
 }
 
-func HandleRequest(req *http.HttpReq, server_configs []config.Server) (*http.HttpRes, error) {
+// HandleRequest routes the request to the matching server and location.
+// Handlers may fill in req_log, e.g. with upstream timings.
+func (session *ClientSession) HandleRequest(req *http.HttpReq, server_configs []config.Server, req_log *logger.RequestLog) (*http.HttpRes, error) {
 	var res *http.HttpRes
 	target := req.Target
 
@@ -124,6 +143,26 @@ func HandleRequest(req *http.HttpReq, server_configs []config.Server) (*http.Htt
 
 	res.Headers["connection"] = req.Headers["connection"]
 
+	if isForwardRequest(req) {
+		forward := findForwardProxy(server_configs)
+
+		if forward != nil {
+			res = session.handleForward(req, *forward, req_log)
+
+			// The connection is a tunnel once CONNECT succeeded
+			if session.Tunnel == nil {
+				setClientConnection(req, res)
+			}
+			return res, nil
+		}
+
+		if req.Method == "CONNECT" {
+			res = http.NewErrorRes(http.StatusMethodNotAllowed)
+			setClientConnection(req, res)
+			return res, nil
+		}
+	}
+
 	host := req.Headers["host"]
 	method := req.Method
 	scheme := req.Scheme
@@ -135,87 +174,125 @@ func HandleRequest(req *http.HttpReq, server_configs []config.Server) (*http.Htt
 		return nil, err
 	}
 
-	target_url.Path = path.Clean(target_url.Path)
+	// Keep the trailing slash, it is significant to location prefixes and upstreams
+	clean_path := path.Clean(target_url.Path)
+	if strings.HasSuffix(target_url.Path, "/") && clean_path != "/" {
+		clean_path += "/"
+	}
+	target_url.Path = clean_path
+
+	session.ClientIP = session.RemoteAddress
 
 	// Handle Configs
 	for _, server_cfg := range server_configs {
 
 		if host == server_cfg.Name || slices.Contains(server_cfg.Hosts, host) {
 
+			session.ClientIP = resolveClientIP(session.RemoteAddress, session.ProxyProtocolAddress, req.Headers, server_cfg)
+
 			// Check if port is part of host
 			if strings.Contains(host, ":") {
 				host = strings.SplitN(host, ":", 2)[0]
 			}
 
-			// Check if Proxy
-			for _, location := range server_cfg.Locations {
+			vars := session.requestVariables(req, req_log.Request.ID)
 
-				// Does not support globbing yet
-				if !strings.HasPrefix(target_url.Path, path.Clean(location.Path)) {
-					continue
-				}
+			req_path := target_url.Path
+			args := target_url.RawQuery
+			rewritten := false
 
-				if location.ProxyPass != "" {
-					origin_server := location.ProxyPass
-					origin_host := ""
-					origin_port_str := ""
+			location := findLocation(server_cfg.Locations, req_path)
 
-					if strings.Contains(origin_server, "://") {
-						scheme_host := strings.SplitN(origin_server, "://", 2)
+			// Rewrites may send the request to another location
+			for cycle := 0; location != nil; cycle++ {
+				result := applyRewrites(location.Rewrites, req_path, args, vars)
 
-						origin_host = scheme_host[1]
+				if !result.changed {
+					break
+				}
 
-						if strings.Contains(origin_host, ":") {
-							origin_host_port := strings.SplitN(origin_host, ":", 2)
-							origin_host = origin_host_port[0]
-							origin_port_str = origin_host_port[1]
-						}
-					}
+				req_path, args, rewritten = result.path, result.args, true
 
-					origin_port, err := strconv.Atoi(origin_port_str)
+				if result.redirect != 0 {
+					res = newRedirectRes(result.redirect, req_path, args)
+					applyResponseHeaders(res, *location, vars)
+					setClientConnection(req, res)
+					return res, nil
+				}
 
-					if err != nil {
-						continue
-					}
+				if result.stop {
+					break
+				}
 
-					res, err = http.MakeRequest(req.Method, origin_host, origin_port, target_url.Path, http.RequestConfig{
-						Headers: req.Headers,
-						Body:    req.Body,
-					})
+				if cycle == MAX_REWRITE_CYCLES {
+					log.Println("Rewrite cycle on", req.Target)
+					res = http.NewErrorRes(http.StatusInternalServerError)
+					setClientConnection(req, res)
+					return res, nil
+				}
 
-					if err != nil {
-						return nil, err
-					}
+				location = findLocation(server_cfg.Locations, req_path)
+			}
 
-					if res.Status == http.StatusMovedPermanently || res.Status == http.StatusFound {
-						location := res.Headers["location"]
+			if location == nil {
+				return res, nil
+			}
 
-						res, err = http.MakeRequest(req.Method, origin_host, origin_port, location, http.RequestConfig{
-							Headers: req.Headers,
-							Body:    req.Body,
-						})
+			// Mirror locations are reached by copies and rewrites only
+			if location.Internal && !rewritten {
+				res = http.NewErrorRes(http.StatusNotFound)
+				setClientConnection(req, res)
+				return res, nil
+			}
 
-						if err != nil {
-							return nil, err
-						}
-					}
+			if location.Return != nil {
+				res = newReturnRes(*location.Return, vars)
+			} else if location.CacheAdmin != "" {
+				res = session.handleCacheAdmin(req, *location, args)
+			} else if location.FastCGIPass != "" {
+				res = session.proxyFastCGI(req, *location, req_path, args, req_log)
+			} else if location.SCGIPass != "" {
+				res = session.proxyGateway(req, *location, req_path, args, req_log, location.SCGIPass, "", location.SCGIParams, http.SCGIRoundTrip)
+			} else if location.UWSGIPass != "" {
+				res = session.proxyGateway(req, *location, req_path, args, req_log, location.UWSGIPass, "", location.UWSGIParams, http.UWSGIRoundTrip)
+			} else if location.CGIRoot != "" {
+				res = session.handleCGI(req, *location, req_path, args, req_log)
+			} else if location.ProxyTarget != nil {
+				target := resolveProxyTarget(location.ProxyTarget)
+				upstream_uri := upstreamURI(req.Target, req_path, args, rewritten, *location, target)
+
+				// Upgraded connections are not mirrored, there is no copy to tunnel
+				if http.IsUpgradeRequest(req.Headers) {
+					res = session.proxyUpgrade(req, *location, upstream_uri, target, req_log)
 				} else {
+					if location.Mirror != "" || location.MirrorTarget != nil {
+						session.mirrorRequest(req, *location, server_cfg.Locations, req_path, args, rewritten, req_log)
+					}
 
-					// Static File Server
-					switch method {
-					case "HEAD":
-						handleHead(target_url.Path, res, location.Root)
-						break
-					case "GET":
-						handleGet(target_url.Path, res, location.Root)
-						break
-					default:
-						return nil, err
+					if location.ProxyCache != "" {
+						res = session.proxyCached(req, *location, upstream_uri, target, req_log)
+					} else {
+						res = session.proxyRequest(req, *location, upstream_uri, target, req_log)
 					}
 				}
-
+			} else {
+
+				// Static File Server
+				switch method {
+				case "HEAD":
+					handleHead(req_path, res, location.Root)
+					break
+				case "GET":
+					handleGet(req_path, res, location.Root)
+					break
+				default:
+					return nil, err
+				}
 			}
 
+			applyResponseHeaders(res, *location, vars)
+			setClientConnection(req, res)
+
 			return res, nil
 		}
 
@@ -225,6 +302,59 @@ func HandleRequest(req *http.HttpReq, server_configs []config.Server) (*http.Htt
 	return res, nil
 }
 
+// setClientConnection keeps the client connection open or closes it as the
+// client asked, unless the handler already decided to close it. Upstream
+// connections are pooled separately.
+func setClientConnection(req *http.HttpReq, res *http.HttpRes) {
+	if http.HasConnectionToken(req.Headers, "close") {
+		res.Headers["connection"] = "close"
+	} else if res.Headers["connection"] != "close" && http.HasConnectionToken(req.Headers, "keep-alive") {
+		res.Headers["connection"] = "keep-alive"
+	}
+}
+
+// newRedirectRes sends the client to path?args
+func newRedirectRes(status http.StatusCode, path string, args string) *http.HttpRes {
+	location := path
+	if args != "" {
+		location += "?" + args
+	}
+
+	res := http.NewErrorRes(status)
+	res.Headers["location"] = location
+
+	return res
+}
+
+// newReturnRes builds the response of the return directive
+func newReturnRes(ret config.Return, vars map[string]string) *http.HttpRes {
+	status := http.StatusCode(ret.Code)
+	text := interpolate(ret.Text, vars)
+
+	if http.IsRedirect(status) {
+		res := http.NewErrorRes(status)
+		res.Headers["location"] = text
+		return res
+	}
+
+	res := http.CreateHttpRes()
+	res.Status = status
+
+	// No body nor length for statuses that cannot have one
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		return res
+	}
+
+	res.Headers["content-length"] = fmt.Sprint(len(text))
+
+	if text != "" {
+		res.Headers["content-type"] = "text/plain; charset=utf-8"
+		res.Body = []byte(text)
+	}
+
+	return res
+}
+
 func handleHead(target_url string, res *http.HttpRes, root_fs string) error {
 	file_path, stat, err := fs.ResolveFilePath(target_url, root_fs)
 
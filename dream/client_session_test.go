@@ -0,0 +1,70 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"testing"
+)
+
+func TestNewReturnRes(t *testing.T) {
+	vars := map[string]string{"host": "example.com", "request_uri": "/a?b=1"}
+
+	tests := []struct {
+		name    string
+		ret     config.Return
+		status  http.StatusCode
+		headers map[string]string
+		body    string
+	}{
+		{
+			name:    "Redirect interpolates the location",
+			ret:     config.Return{Code: 301, Text: "https://$host${request_uri}"},
+			status:  http.StatusMovedPermanently,
+			headers: map[string]string{"location": "https://example.com/a?b=1"},
+			body:    "<h1>301 Moved Permanently</h1>",
+		},
+		{
+			name:    "Text body",
+			ret:     config.Return{Code: 200, Text: "served by $host"},
+			status:  http.StatusOK,
+			headers: map[string]string{"content-type": "text/plain; charset=utf-8", "content-length": "21"},
+			body:    "served by example.com",
+		},
+		{
+			name:    "No text",
+			ret:     config.Return{Code: 403},
+			status:  http.StatusForbidden,
+			headers: map[string]string{"content-type": "", "content-length": "0"},
+		},
+		{
+			name:    "No length for 204",
+			ret:     config.Return{Code: 204},
+			status:  http.StatusNoContent,
+			headers: map[string]string{"content-length": ""},
+		},
+		{
+			name:    "No length for 304",
+			ret:     config.Return{Code: 304},
+			status:  http.StatusNotModified,
+			headers: map[string]string{"content-length": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := newReturnRes(tt.ret, vars)
+
+			if res.Status != tt.status {
+				t.Errorf("status = %d, want %d", res.Status, tt.status)
+			}
+			for name, want := range tt.headers {
+				if got := res.Headers[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if string(res.Body) != tt.body {
+				t.Errorf("body = %q, want %q", res.Body, tt.body)
+			}
+		})
+	}
+}
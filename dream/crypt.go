@@ -0,0 +1,164 @@
+package dream
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	CRYPT_DEFAULT_ROUNDS = 5000
+	CRYPT_MIN_ROUNDS     = 1000
+	CRYPT_MAX_ROUNDS     = 999999999
+	CRYPT_MAX_SALT       = 16
+
+	CRYPT_ALPHABET = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// Order in which the digest bytes are encoded, three at a time
+var (
+	sha256CryptOrder = [][]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}, {31, 30},
+	}
+	sha512CryptOrder = [][]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26},
+		{6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32},
+		{12, 33, 54}, {34, 55, 13}, {56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38},
+		{18, 39, 60}, {40, 61, 19}, {62, 20, 41}, {63},
+	}
+)
+
+// checkPassword verifies password against a SHA-crypt hash, "$5$" or "$6$"
+// as made by openssl passwd -5 or -6
+func checkPassword(password string, hashed string) bool {
+	expected, ok := shaCrypt(password, hashed)
+	return ok && subtle.ConstantTimeCompare([]byte(expected), []byte(hashed)) == 1
+}
+
+// shaCrypt hashes password with the algorithm, rounds and salt of hashed
+func shaCrypt(password string, hashed string) (string, bool) {
+	var new_hash func() hash.Hash
+	var order [][]int
+
+	switch {
+	case strings.HasPrefix(hashed, "$5$"):
+		new_hash, order = sha256.New, sha256CryptOrder
+	case strings.HasPrefix(hashed, "$6$"):
+		new_hash, order = sha512.New, sha512CryptOrder
+	default:
+		return "", false
+	}
+
+	prefix := hashed[:3]
+	salt := hashed[3:]
+	rounds := CRYPT_DEFAULT_ROUNDS
+	rounds_param := ""
+
+	if value, ok := strings.CutPrefix(salt, "rounds="); ok {
+		count, rest, found := strings.Cut(value, "$")
+		n, err := strconv.Atoi(count)
+
+		if !found || err != nil {
+			return "", false
+		}
+
+		rounds = min(max(n, CRYPT_MIN_ROUNDS), CRYPT_MAX_ROUNDS)
+		rounds_param = "rounds=" + strconv.Itoa(rounds) + "$"
+		salt = rest
+	}
+
+	salt, _, _ = strings.Cut(salt, "$")
+	salt = salt[:min(len(salt), CRYPT_MAX_SALT)]
+
+	key := []byte(password)
+
+	digest := func(parts ...[]byte) []byte {
+		h := new_hash()
+		for _, part := range parts {
+			h.Write(part)
+		}
+		return h.Sum(nil)
+	}
+
+	// repeat stretches sum over n bytes
+	repeat := func(sum []byte, n int) []byte {
+		out := make([]byte, 0, n)
+		for len(out) < n {
+			out = append(out, sum[:min(len(sum), n-len(out))]...)
+		}
+		return out
+	}
+
+	alternate := digest(key, []byte(salt), key)
+
+	h := new_hash()
+	h.Write(key)
+	h.Write([]byte(salt))
+	h.Write(repeat(alternate, len(key)))
+
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 == 1 {
+			h.Write(alternate)
+		} else {
+			h.Write(key)
+		}
+	}
+
+	sum := h.Sum(nil)
+
+	p_bytes := repeat(digest(repeatBytes(key, len(key))...), len(key))
+	s_bytes := repeat(digest(repeatBytes([]byte(salt), 16+int(sum[0]))...), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		h := new_hash()
+
+		if i&1 == 1 {
+			h.Write(p_bytes)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(s_bytes)
+		}
+		if i%7 != 0 {
+			h.Write(p_bytes)
+		}
+		if i&1 == 1 {
+			h.Write(sum)
+		} else {
+			h.Write(p_bytes)
+		}
+
+		sum = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(prefix + rounds_param + salt + "$")
+
+	for _, group := range order {
+		value, chars := 0, len(group)+1
+
+		for _, i := range group {
+			value = value<<8 | int(sum[i])
+		}
+
+		for ; chars > 0; chars-- {
+			sb.WriteByte(CRYPT_ALPHABET[value&0x3f])
+			value >>= 6
+		}
+	}
+
+	return sb.String(), true
+}
+
+func repeatBytes(value []byte, count int) [][]byte {
+	parts := make([][]byte, count)
+	for i := range parts {
+		parts[i] = value
+	}
+	return parts
+}
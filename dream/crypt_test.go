@@ -0,0 +1,28 @@
+package dream
+
+import "testing"
+
+func TestCheckPassword(t *testing.T) {
+	// Made by openssl passwd
+	tests := []struct {
+		password string
+		hashed   string
+		want     bool
+	}{
+		{"Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5", true},
+		{"Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1", true},
+		{"Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.", true},
+		{"a much longer password that exceeds the thirty two byte digest size", "$5$rounds=1200$abc$a.T0gPSgVwmrufVULXoHRE6lrbMnKLfFIi62Vc1IZTC", true},
+		{"x", "$6$rounds=1000$longsaltlongsalt$2pede1qj0NWkCSsfzmM2WhOmlSX1vYWgi44KerMcoqQnee79uRsCCelXSCyu7CB9EmNhJOiwfMoGmX65DtwR/1", true},
+		{"s3cret", "$6$q7Zc2LbXv4$A9KDKiONcPtYYGCyIIYZ85REMwLqhVDJdsn025YExsn.aTscaZyWNhmrwV2dEMtNO9spvNZP.hTtsiAD9Lo.U.", true},
+		{"wrong", "$6$q7Zc2LbXv4$A9KDKiONcPtYYGCyIIYZ85REMwLqhVDJdsn025YExsn.aTscaZyWNhmrwV2dEMtNO9spvNZP.hTtsiAD9Lo.U.", false},
+		{"s3cret", "s3cret", false},
+		{"s3cret", "$1$q7Zc2LbX$jY0Qqnb3Z7rDN1m0Jw6vN.", false},
+	}
+
+	for _, tt := range tests {
+		if got := checkPassword(tt.password, tt.hashed); got != tt.want {
+			t.Errorf("checkPassword(%q, %q) = %v, want %v", tt.password, tt.hashed, got, tt.want)
+		}
+	}
+}
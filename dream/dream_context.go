@@ -2,16 +2,25 @@ package dream
 
 import (
 	"dreamproxy/config"
+	"dreamproxy/logger"
+	"dreamproxy/proxyproto"
 	"fmt"
 	"log"
 	"net"
+	"time"
 )
 
 const PROTOCOL string = "tcp4"
 
+// How long a client has to send its PROXY protocol header
+const PROXY_PROTOCOL_TIMEOUT = 5 * time.Second
+
 type DreamContext struct {
 	Port    string
 	Servers []config.Server
+
+	// Every connection on the port starts with a PROXY protocol header
+	ProxyProtocol bool
 }
 
 func (ctxt *DreamContext) RunDreamContext() {
@@ -34,16 +43,50 @@ func (ctxt *DreamContext) RunDreamContext() {
 			continue
 		}
 
-		client_session := NewClientSession(connection)
+		go ctxt.handleConnection(connection)
+	}
+}
+
+func (ctxt *DreamContext) handleConnection(connection net.Conn) {
+	var header *proxyproto.Header
+
+	if ctxt.ProxyProtocol {
+		var err error
 
-		go client_session.HandleConnection(ctxt.Servers)
+		connection.SetReadDeadline(time.Now().Add(PROXY_PROTOCOL_TIMEOUT))
+		header, err = proxyproto.ReadHeader(connection)
+		connection.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			log := logger.NewRequestLog(logger.DREAM_SERVER, logger.ERROR, logger.REQ_PARSE_ERROR, "invalid PROXY protocol header: "+err.Error())
+			log.Request.ClientIP = connection.RemoteAddr().String()
+			fmt.Println(log.ToText())
+			connection.Close()
+			return
+		}
+	}
+
+	client_session := NewClientSession(connection)
+
+	if header != nil && header.Source != nil {
+		client_session.ProxyProtocolAddress = header.Source.IP.String()
+		client_session.ProxyProtocolPort = fmt.Sprint(header.Source.Port)
 	}
+
+	client_session.HandleConnection(ctxt.Servers)
 }
 
 func NewDreamContext(port string, servers []config.Server) DreamContext {
+	proxy_protocol := false
+
+	// The listener is shared, so one server asking for it is enough
+	for _, server := range servers {
+		proxy_protocol = proxy_protocol || server.Listen.ProxyProtocol
+	}
 
 	return DreamContext{
-		Port:    port,
-		Servers: servers,
+		Port:          port,
+		Servers:       servers,
+		ProxyProtocol: proxy_protocol,
 	}
 }
@@ -0,0 +1,45 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/fastcgi"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// proxyFastCGI passes the request to the fastcgi_pass application
+func (session *ClientSession) proxyFastCGI(req *http.HttpReq, location config.Location, req_path string, args string, req_log *logger.RequestLog) *http.HttpRes {
+	round_trip := func(conn io.ReadWriter, env map[string]string, body []byte) (*http.HttpRes, error) {
+		fcgi_res, err := fastcgi.Do(conn, fastcgiParams(env), body)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(fcgi_res.Stderr) > 0 {
+			logUpstreamFailure(req, req_log, nil, fmt.Errorf("fastcgi stderr: %s", strings.TrimSpace(string(fcgi_res.Stderr))), false)
+		}
+
+		return http.ParseCGIResponse(fcgi_res.Stdout)
+	}
+
+	return session.proxyGateway(req, location, req_path, args, req_log, location.FastCGIPass, location.FastCGIIndex, location.FastCGIParams, round_trip)
+}
+
+func fastcgiParams(env map[string]string) []fastcgi.Param {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]fastcgi.Param, 0, len(names))
+	for _, name := range names {
+		params = append(params, fastcgi.Param{Name: name, Value: env[name]})
+	}
+
+	return params
+}
@@ -0,0 +1,294 @@
+package dream
+
+import (
+	"context"
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"encoding/base64"
+	"maps"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const FORWARD_PROXY_REALM = "dreamproxy"
+
+// isForwardRequest tells whether the request is meant for a forward proxy:
+// a CONNECT or an absolute-form target
+func isForwardRequest(req *http.HttpReq) bool {
+	return req.Method == "CONNECT" || strings.HasPrefix(req.Target, "http://") || strings.HasPrefix(req.Target, "https://")
+}
+
+func findForwardProxy(server_configs []config.Server) *config.Server {
+	for i := range server_configs {
+		if server_configs[i].ForwardProxy {
+			return &server_configs[i]
+		}
+	}
+	return nil
+}
+
+// handleForward proxies an absolute-form request, or opens a CONNECT
+// tunnel kept in session.Tunnel, to a destination allowed by server_cfg
+func (session *ClientSession) handleForward(req *http.HttpReq, server_cfg config.Server, req_log *logger.RequestLog) *http.HttpRes {
+	session.ClientIP = resolveClientIP(session.RemoteAddress, session.ProxyProtocolAddress, req.Headers, server_cfg)
+
+	if !checkProxyAuth(req.Headers["proxy-authorization"], server_cfg.ForwardProxyUsers) {
+		res := http.NewErrorRes(http.StatusProxyAuthRequired)
+		res.Headers["proxy-authenticate"] = "Basic realm=\"" + FORWARD_PROXY_REALM + "\""
+		return res
+	}
+
+	authority := req.Target
+	host_header := ""
+	target_uri := ""
+
+	if req.Method != "CONNECT" {
+		target_url, err := url.Parse(req.Target)
+
+		// TLS to the destination is left to clients, through CONNECT
+		if err != nil || target_url.Scheme != "http" || target_url.Host == "" {
+			return http.NewErrorRes(http.StatusBadRequest)
+		}
+
+		authority = target_url.Host
+		host_header = target_url.Host
+		if target_url.Port() == "" {
+			authority = net.JoinHostPort(target_url.Hostname(), "80")
+		}
+		target_uri = target_url.RequestURI()
+	}
+
+	host, port_str, err := net.SplitHostPort(authority)
+	port, port_err := strconv.Atoi(port_str)
+
+	if err != nil || port_err != nil {
+		return http.NewErrorRes(http.StatusBadRequest)
+	}
+
+	// Names are resolved once, so the address checked is the one dialed
+	ip, err := resolveDestination(host)
+	if err != nil {
+		return http.NewErrorRes(http.StatusBadGateway)
+	}
+
+	if !isDestinationAllowed(host, ip, port, server_cfg) {
+		return http.NewErrorRes(http.StatusForbidden)
+	}
+
+	req_log.Trace.UpstreamIP = net.JoinHostPort(ip.String(), port_str)
+	upstream_start := time.Now()
+
+	if req.Method == "CONNECT" {
+		dialer := net.Dialer{Timeout: DEFAULT_PROXY_CONNECT_TIMEOUT}
+		conn, err := dialer.Dial("tcp", req_log.Trace.UpstreamIP)
+
+		req_log.Trace.UpstreamLatencyMS = time.Since(upstream_start).Milliseconds()
+
+		if err != nil {
+			logUpstreamFailure(req, req_log, nil, err, false)
+
+			if http.IsTimeout(err) {
+				return http.NewErrorRes(http.StatusGatewayTimeout)
+			}
+			return http.NewErrorRes(http.StatusBadGateway)
+		}
+
+		session.Tunnel = conn
+		session.TunnelIdleTimeout = DEFAULT_PROXY_READ_TIMEOUT
+
+		res := http.CreateHttpRes()
+		res.Status = http.StatusOK
+		return res
+	}
+
+	headers := maps.Clone(req.Headers)
+	http.RemoveHopByHopHeaders(headers)
+	headers["host"] = host_header
+
+	res, err := http.MakeRequest(req.Method, ip.String(), port, target_uri, http.RequestConfig{
+		Headers: headers,
+		Body:    req.Body,
+		Transport: http.Transport{
+			Timeouts: http.Timeouts{
+				Connect: DEFAULT_PROXY_CONNECT_TIMEOUT,
+				Send:    DEFAULT_PROXY_SEND_TIMEOUT,
+				Read:    DEFAULT_PROXY_READ_TIMEOUT,
+			},
+		},
+	})
+
+	req_log.Trace.UpstreamLatencyMS = time.Since(upstream_start).Milliseconds()
+
+	if err != nil {
+		logUpstreamFailure(req, req_log, res, err, false)
+
+		if http.IsTimeout(err) {
+			return http.NewErrorRes(http.StatusGatewayTimeout)
+		}
+		return http.NewErrorRes(http.StatusBadGateway)
+	}
+
+	res.SetReverseProxyHeaders()
+
+	return res
+}
+
+// checkProxyAuth validates Basic credentials against the password hashes
+// of users, anyone is let in when no user is configured
+func checkProxyAuth(authorization string, users map[string]string) bool {
+	if len(users) == 0 {
+		return true
+	}
+
+	scheme, encoded, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+
+	name, password, found := strings.Cut(string(decoded), ":")
+	expected, known := users[name]
+
+	if !found || !known {
+		return false
+	}
+
+	return checkPassword(password, expected)
+}
+
+func resolveDestination(host string) (netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Unmap(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_PROXY_CONNECT_TIMEOUT)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addrs[0].Unmap(), nil
+}
+
+// isDestinationAllowed checks the destination against the deny patterns,
+// then the allow ones if any. Patterns match the requested host or the
+// address it resolved to. Addresses of this host are denied unless an
+// allow pattern names them, wildcards do not count.
+func isDestinationAllowed(host string, ip netip.Addr, port int, server_cfg config.Server) bool {
+	for _, pattern := range server_cfg.ForwardProxyDeny {
+		if matchDestination(pattern, host, ip, port) {
+			return false
+		}
+	}
+
+	if isLocalDestination(ip) {
+		for _, pattern := range server_cfg.ForwardProxyAllow {
+			if !isWildcardPattern(pattern) && matchDestination(pattern, host, ip, port) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(server_cfg.ForwardProxyAllow) == 0 {
+		return true
+	}
+
+	for _, pattern := range server_cfg.ForwardProxyAllow {
+		if matchDestination(pattern, host, ip, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchDestination matches a host[:port] pattern. The host is "*", a
+// "*.example.com" wildcard, a CIDR or an exact name or address, the port
+// a number or "*".
+func matchDestination(pattern string, host string, ip netip.Addr, port int) bool {
+	pattern_host, pattern_port := pattern, "*"
+
+	// A bare IPv6 address has no port, "[::1]:443" has one
+	if i := strings.LastIndex(pattern, ":"); i != -1 {
+		before, after := pattern[:i], pattern[i+1:]
+		bare_ipv6 := strings.Contains(before, ":") && !strings.HasSuffix(before, "]")
+
+		if !bare_ipv6 && (after == "*" || isDigits(after)) {
+			pattern_host, pattern_port = before, after
+		}
+	}
+
+	pattern_host = strings.Trim(pattern_host, "[]")
+
+	if pattern_port != "*" && pattern_port != strconv.Itoa(port) {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	pattern_host = strings.ToLower(pattern_host)
+
+	switch {
+	case pattern_host == "*":
+		return true
+	case strings.HasPrefix(pattern_host, "*."):
+		return strings.HasSuffix(host, pattern_host[1:])
+	case strings.Contains(pattern_host, "/"):
+		prefix, err := netip.ParsePrefix(pattern_host)
+		return err == nil && prefix.Contains(ip)
+	default:
+		if addr, err := netip.ParseAddr(pattern_host); err == nil {
+			return addr.Unmap() == ip
+		}
+		return pattern_host == host
+	}
+}
+
+// isLocalDestination tells whether ip reaches this host or its link: the
+// proxy's own listeners, and services that trust loopback clients
+func isLocalDestination(ip netip.Addr) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if prefix, err := netip.ParsePrefix(addr.String()); err == nil && prefix.Addr().Unmap() == ip {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isWildcardPattern tells whether the host of a pattern is "*" or "*.name"
+func isWildcardPattern(pattern string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(pattern, "["), "*")
+}
+
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, ch := range value {
+		if ch < '0' || ch > '9' {
+			return false
+		}
+	}
+	return true
+}
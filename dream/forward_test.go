@@ -0,0 +1,138 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"encoding/base64"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestIsDestinationAllowed(t *testing.T) {
+	server_cfg := config.Server{
+		ForwardProxyAllow: []string{"*.example.com:443", "api.test:*", "192.0.2.0/24"},
+		ForwardProxyDeny:  []string{"10.0.0.0/8", "admin.example.com", "[2001:db8::1]:443"},
+	}
+
+	tests := []struct {
+		name string
+		host string
+		ip   string
+		port int
+		want bool
+	}{
+		{"Wildcard and port", "www.example.com", "203.0.113.1", 443, true},
+		{"Wildcard, other port", "www.example.com", "203.0.113.1", 80, false},
+		{"Any port", "api.test", "203.0.113.2", 8080, true},
+		{"CIDR", "192.0.2.7", "192.0.2.7", 22, true},
+		{"Denied name", "admin.example.com", "203.0.113.3", 443, false},
+		{"Name resolving to a denied address", "intranet.example.com", "10.1.2.3", 443, false},
+		{"Denied IPv6 and port", "2001:db8::1", "2001:db8::1", 443, false},
+		{"Not allowed", "other.org", "198.51.100.1", 443, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := netip.MustParseAddr(tt.ip)
+			if got := isDestinationAllowed(tt.host, ip, tt.port, server_cfg); got != tt.want {
+				t.Errorf("isDestinationAllowed(%s, %s, %d) = %v, want %v", tt.host, tt.ip, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsDestinationAllowedLocal(t *testing.T) {
+	open := config.Server{}
+	wildcard := config.Server{ForwardProxyAllow: []string{"*", "*.example.com"}}
+	explicit := config.Server{ForwardProxyAllow: []string{"127.0.0.1:8080", "localhost:*", "169.254.0.0/16"}}
+
+	tests := []struct {
+		name       string
+		server_cfg config.Server
+		host       string
+		ip         string
+		port       int
+		want       bool
+	}{
+		{"Public address", open, "example.org", "203.0.113.1", 80, true},
+		{"Loopback", open, "127.0.0.1", "127.0.0.1", 8080, false},
+		{"Loopback range", open, "127.1.2.3", "127.1.2.3", 80, false},
+		{"IPv6 loopback", open, "::1", "::1", 80, false},
+		{"Unspecified", open, "0.0.0.0", "0.0.0.0", 80, false},
+		{"Link-local", open, "169.254.169.254", "169.254.169.254", 80, false},
+		{"IPv6 link-local", open, "fe80::1", "fe80::1", 80, false},
+		{"Name resolving to loopback", open, "localhost", "127.0.0.1", 80, false},
+		{"Wildcards", wildcard, "local.example.com", "127.0.0.1", 80, false},
+		{"Explicit address", explicit, "127.0.0.1", "127.0.0.1", 8080, true},
+		{"Explicit address, other port", explicit, "127.0.0.1", "127.0.0.1", 8081, false},
+		{"Explicit name", explicit, "localhost", "127.0.0.1", 80, true},
+		{"Explicit CIDR", explicit, "169.254.169.254", "169.254.169.254", 80, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := netip.MustParseAddr(tt.ip)
+			if got := isDestinationAllowed(tt.host, ip, tt.port, tt.server_cfg); got != tt.want {
+				t.Errorf("isDestinationAllowed(%s, %s, %d) = %v, want %v", tt.host, tt.ip, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckProxyAuth(t *testing.T) {
+	users := map[string]string{"ana": "$6$q7Zc2LbXv4$A9KDKiONcPtYYGCyIIYZ85REMwLqhVDJdsn025YExsn.aTscaZyWNhmrwV2dEMtNO9spvNZP.hTtsiAD9Lo.U."}
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	if !checkProxyAuth("", nil) {
+		t.Error("expected no auth to be required without users")
+	}
+	if !checkProxyAuth(basic("ana:s3cret"), users) {
+		t.Error("expected valid credentials to pass")
+	}
+	if checkProxyAuth(basic("ana:wrong"), users) {
+		t.Error("expected a wrong password to fail")
+	}
+	if checkProxyAuth("", users) {
+		t.Error("expected missing credentials to fail")
+	}
+}
+
+func TestConnectResponse(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	servers := []config.Server{{Name: "proxy", ForwardProxy: true, ForwardProxyAllow: []string{"127.0.0.1:*"}}}
+	req := &http.HttpReq{
+		Method:  "CONNECT",
+		Target:  ln.Addr().String(),
+		Version: string(http.V1_1),
+		Headers: map[string]string{"host": ln.Addr().String(), "connection": "keep-alive"},
+	}
+
+	conn, _ := net.Pipe()
+	session := ClientSession{RemoteAddress: "192.0.2.1", Connection: conn}
+	req_log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
+
+	res, err := session.HandleRequest(req, servers, &req_log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Tunnel == nil {
+		t.Fatalf("no tunnel opened, status %d", res.Status)
+	}
+	defer session.Tunnel.Close()
+
+	if res.Status != http.StatusOK {
+		t.Errorf("status = %d, want 200", res.Status)
+	}
+	if connection, ok := res.Headers["connection"]; ok {
+		t.Errorf("unexpected connection header %q", connection)
+	}
+}
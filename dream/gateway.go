@@ -0,0 +1,53 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"io"
+	"time"
+)
+
+// gatewayRoundTrip speaks FastCGI, SCGI or uwsgi on a connection of its own
+type gatewayRoundTrip func(conn io.ReadWriter, env map[string]string, body []byte) (*http.HttpRes, error)
+
+// proxyGateway passes the request to the application at address
+func (session *ClientSession) proxyGateway(req *http.HttpReq, location config.Location, req_path string, args string, req_log *logger.RequestLog, address string, index string, params []config.CGIParam, round_trip gatewayRoundTrip) *http.HttpRes {
+	vars := session.requestVariables(req, req_log.Request.ID)
+	env := session.cgiVariables(req, location, req_path, args, index, vars)
+	vars["fastcgi_script_name"] = vars["script_name"]
+
+	applyCGIParams(env, params, vars)
+
+	timeouts := proxyTimeouts(location)
+
+	req_log.Trace.UpstreamIP = address
+	start := time.Now()
+
+	res, err := fetchGateway(address, timeouts, env, req.Body, round_trip)
+
+	req_log.Trace.UpstreamLatencyMS = time.Since(start).Milliseconds()
+
+	if err != nil {
+		logUpstreamFailure(req, req_log, nil, err, false)
+		return upstreamErrorRes(err)
+	}
+
+	res.SetReverseProxyHeaders()
+
+	if req.Method == "HEAD" {
+		res.Body = nil
+	}
+
+	return res
+}
+
+func fetchGateway(address string, timeouts http.Timeouts, env map[string]string, body []byte, round_trip gatewayRoundTrip) (*http.HttpRes, error) {
+	conn, err := http.Dial(address, timeouts.Connect)
+	if err != nil {
+		return nil, &http.ConnectError{Err: err}
+	}
+	defer conn.Close()
+
+	return round_trip(http.NewTimeoutConn(conn, timeouts), env, body)
+}
@@ -0,0 +1,96 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"slices"
+	"strings"
+)
+
+// Responses getting add_header values without "always"
+var ADD_HEADER_STATUSES = []http.StatusCode{
+	http.StatusOK,
+	http.StatusCreated,
+	http.StatusNoContent,
+	http.StatusPartialContent,
+	http.StatusMovedPermanently,
+	http.StatusFound,
+	http.StatusSeeOther,
+	http.StatusNotModified,
+	http.StatusTemporaryRedirect,
+	http.StatusPermanentRedirect,
+}
+
+// applyResponseHeaders runs remove_header then add_header on a response
+// produced by the location
+func applyResponseHeaders(res *http.HttpRes, location config.Location, vars map[string]string) {
+	for _, name := range location.RemoveHeaders {
+		delete(res.Headers, name)
+	}
+	res.RemovedHeaders = location.RemoveHeaders
+
+	for _, header := range location.AddHeaders {
+		if !header.Always && !slices.Contains(ADD_HEADER_STATUSES, res.Status) {
+			continue
+		}
+
+		value := interpolate(header.Value, vars)
+
+		if value == "" {
+			continue
+		}
+
+		res.Headers[header.Name] = value
+	}
+}
+
+// rewriteRedirects applies proxy_redirect to the Location and Refresh
+// headers of an upstream response. The default rule replaces origins, the
+// base URLs of the proxied server (e.g. "http://localhost:8000"), with base.
+func rewriteRedirects(headers map[string]string, location config.Location, origins []string, base string, vars map[string]string) {
+	if location.ProxyRedirectOff {
+		return
+	}
+
+	redirects := location.ProxyRedirects
+	if redirects == nil {
+		redirects = []config.ProxyRedirect{{Default: true}}
+	}
+
+	rewrite := func(url string) string {
+		for _, redirect := range redirects {
+			if redirect.Default {
+				for _, origin := range origins {
+					rest, ok := strings.CutPrefix(url, origin)
+					if !ok || !(rest == "" || strings.HasPrefix(rest, "/") || strings.HasSuffix(origin, "/")) {
+						continue
+					}
+
+					if base+rest == "" {
+						return "/"
+					}
+					return base + rest
+				}
+				continue
+			}
+
+			if rest, ok := strings.CutPrefix(url, redirect.From); ok {
+				return interpolate(redirect.To, vars) + rest
+			}
+		}
+		return url
+	}
+
+	if value := headers["location"]; value != "" {
+		headers["location"] = rewrite(value)
+	}
+
+	// Refresh: <seconds>; url=<url>
+	if value := headers["refresh"]; value != "" {
+		i := strings.Index(strings.ToLower(value), "url=")
+		if i != -1 {
+			start := i + len("url=")
+			headers["refresh"] = value[:start] + rewrite(value[start:])
+		}
+	}
+}
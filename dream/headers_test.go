@@ -0,0 +1,86 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"testing"
+)
+
+func TestRewriteRedirects(t *testing.T) {
+	origins := []string{"http://localhost:8000", "https://localhost:8000"}
+	vars := map[string]string{"host": "example.com"}
+
+	tests := []struct {
+		name     string
+		location config.Location
+		headers  map[string]string
+		want     map[string]string
+	}{
+		{
+			name:    "Default strips the upstream origin",
+			headers: map[string]string{"location": "http://localhost:8000/login?next=/"},
+			want:    map[string]string{"location": "/login?next=/"},
+		},
+		{
+			name:    "Default leaves other hosts alone",
+			headers: map[string]string{"location": "http://localhost:80001/login"},
+			want:    map[string]string{"location": "http://localhost:80001/login"},
+		},
+		{
+			name:     "Off",
+			location: config.Location{ProxyRedirectOff: true},
+			headers:  map[string]string{"location": "http://localhost:8000/"},
+			want:     map[string]string{"location": "http://localhost:8000/"},
+		},
+		{
+			name: "Explicit rule with variables",
+			location: config.Location{ProxyRedirects: []config.ProxyRedirect{
+				{From: "http://localhost:8000/app/", To: "https://$host/"},
+			}},
+			headers: map[string]string{"location": "http://localhost:8000/app/home"},
+			want:    map[string]string{"location": "https://example.com/home"},
+		},
+		{
+			name:    "Refresh url",
+			headers: map[string]string{"refresh": "5; URL=https://localhost:8000/done"},
+			want:    map[string]string{"refresh": "5; URL=/done"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rewriteRedirects(tt.headers, tt.location, origins, "", vars)
+
+			for name, want := range tt.want {
+				if got := tt.headers[name]; got != want {
+					t.Errorf("%s = %s, want %s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveServerHeaders(t *testing.T) {
+	location := config.Location{RemoveHeaders: []string{"server", "date", "via"}}
+
+	res := http.CreateHttpRes()
+	res.Headers["server"] = "upstream"
+	applyResponseHeaders(res, location, nil)
+
+	// Added last, when the response is written
+	res.SetServerHeaders()
+
+	for _, name := range []string{"server", "date", "via", "Via"} {
+		if value, ok := res.Headers[name]; ok {
+			t.Errorf("%s = %q, expected it removed", name, value)
+		}
+	}
+
+	res = http.CreateHttpRes()
+	applyResponseHeaders(res, config.Location{}, nil)
+	res.SetServerHeaders()
+
+	if res.Headers["server"] == "" || res.Headers["date"] == "" || res.Headers["Via"] == "" {
+		t.Errorf("server headers missing: %v", res.Headers)
+	}
+}
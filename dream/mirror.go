@@ -0,0 +1,99 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"fmt"
+	"maps"
+	"time"
+)
+
+// Copies beyond are dropped rather than piling up behind a slow mirror
+const MAX_MIRROR_REQUESTS = 1024
+
+var mirror_slots = make(chan struct{}, MAX_MIRROR_REQUESTS)
+
+// mirrorRequest sends a copy of the request in the background, its
+// response is only logged
+func (session *ClientSession) mirrorRequest(req *http.HttpReq, location config.Location, locations []config.Location, req_path string, args string, rewritten bool, req_log *logger.RequestLog) {
+	mirror := mirrorLocation(location, locations)
+
+	if mirror == nil {
+		return
+	}
+
+	// The copy outlives the request, it gets its own copies
+	mirror_session := *session
+	mirror_req := *req
+	mirror_req.Headers = maps.Clone(req.Headers)
+	mirror_log := *req_log
+	mirror_log.Service = string(logger.MIRROR)
+	mirror_log.Request.ClientIP = session.ClientIP
+
+	select {
+	case mirror_slots <- struct{}{}:
+	default:
+		logMirror(&mirror_req, &mirror_log, logger.WARN, logger.MIRROR_DROPPED, nil, "too many mirror requests in flight", 0)
+		return
+	}
+
+	target := resolveProxyTarget(mirror.ProxyTarget)
+	target_uri := upstreamURI(req.Target, req_path, args, rewritten, location, target)
+
+	go func() {
+		defer func() { <-mirror_slots }()
+
+		start := time.Now()
+		res, err := mirror_session.fetchUpstream(&mirror_req, *mirror, target_uri, target, &mirror_log)
+		latency := time.Since(start)
+
+		if err != nil {
+			logMirror(&mirror_req, &mirror_log, logger.WARN, logger.MIRROR_ERROR, nil, err.Error(), latency)
+			return
+		}
+
+		logMirror(&mirror_req, &mirror_log, logger.INFO, logger.MIRROR_REQUEST, res, "", latency)
+	}()
+}
+
+// mirrorLocation gives the settings the copies are sent with
+func mirrorLocation(location config.Location, locations []config.Location) *config.Location {
+	if location.MirrorTarget != nil {
+		mirror := location
+		mirror.ProxyTarget = location.MirrorTarget
+		mirror.FollowRedirects = 0
+		return &mirror
+	}
+
+	if location.Mirror == "" {
+		return nil
+	}
+
+	for i := range locations {
+		if locations[i].Path == location.Mirror && locations[i].ProxyTarget != nil {
+			mirror := locations[i]
+			return &mirror
+		}
+	}
+
+	return nil
+}
+
+func logMirror(req *http.HttpReq, req_log *logger.RequestLog, level logger.LogLevel, event logger.LogEvent, res *http.HttpRes, msg string, latency time.Duration) {
+	log := logger.NewRequestLog(logger.MIRROR, level, event, msg)
+	log.Request = req_log.Request
+	log.Request.Method = req.Method
+	log.Request.Path = req.Target
+	log.Request.Host = req.Headers["host"]
+	log.Trace = req_log.Trace
+	log.Trace.CorrelationID = req_log.Request.ID
+	log.Response.LatencyMS = latency.Milliseconds()
+
+	if res != nil {
+		log.Response.StatusCode = int(res.Status)
+		log.Response.BytesSent = int64(len(res.Body))
+	}
+
+	fmt.Println(log.ToText())
+}
@@ -0,0 +1,144 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorLocation(t *testing.T) {
+	shadow := &config.ProxyTarget{Scheme: "http", Host: "shadow", Port: 80, Authority: "shadow"}
+
+	locations := []config.Location{
+		{Path: "/_mirror", ProxyTarget: shadow, ReadTimeout: time.Second},
+		{Path: "/_static", Root: "/srv"},
+	}
+
+	tests := []struct {
+		name     string
+		location config.Location
+		want     *config.ProxyTarget
+	}{
+		{
+			name:     "Mirror location",
+			location: config.Location{Path: "/", Mirror: "/_mirror"},
+			want:     shadow,
+		},
+		{
+			name:     "Mirror location without proxy_pass",
+			location: config.Location{Path: "/", Mirror: "/_static"},
+		},
+		{
+			name:     "Mirror pass",
+			location: config.Location{Path: "/", MirrorTarget: shadow, FollowRedirects: 3},
+			want:     shadow,
+		},
+		{
+			name:     "No mirror",
+			location: config.Location{Path: "/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mirror := mirrorLocation(tt.location, locations)
+
+			if tt.want == nil {
+				if mirror != nil {
+					t.Fatalf("got mirror %+v", mirror)
+				}
+				return
+			}
+
+			if mirror == nil || mirror.ProxyTarget != tt.want || mirror.FollowRedirects != 0 {
+				t.Fatalf("got %+v", mirror)
+			}
+		})
+	}
+
+	// The settings of the mirror location apply to the copies
+	if mirror := mirrorLocation(config.Location{Mirror: "/_mirror"}, locations); mirror.ReadTimeout != time.Second {
+		t.Errorf("read timeout of the mirror location not kept")
+	}
+}
+
+func TestMirrorProxiedRequestsOnly(t *testing.T) {
+	copies := make(chan string, 10)
+
+	shadow_host, shadow_port := startOrigin(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		copies <- r.URL.Path
+	})
+	origin_host, origin_port := startOrigin(t, echoRequest)
+
+	cfg := config.ParseDreamFile(fmt.Sprintf(`
+servers {
+  server {
+    name example.com
+    listen 8080
+
+    location / {
+      proxy_pass http://%s:%d
+      mirror /_shadow
+    }
+
+    location /_shadow {
+      proxy_pass http://%s:%d
+    }
+
+    location /maintenance {
+      return 503 "back soon"
+      proxy_pass http://%[1]s:%[2]d
+      mirror /_shadow
+    }
+  }
+}
+`, origin_host, origin_port, shadow_host, shadow_port))
+
+	conn, _ := net.Pipe()
+	session := ClientSession{RemoteAddress: "192.0.2.1", Connection: conn}
+
+	get := func(target string) *http.HttpRes {
+		req := &http.HttpReq{Method: "GET", Scheme: "http", Target: target, Version: "1.1", Headers: map[string]string{"host": "example.com"}}
+		req_log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
+
+		res, err := session.HandleRequest(req, cfg.Servers, &req_log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := get("/_shadow/x"); res.Status != http.StatusNotFound {
+		t.Errorf("mirror location reached by a client: %d", res.Status)
+	}
+
+	if res := get("/maintenance"); res.Status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", res.Status)
+	}
+
+	if res := get("/page"); !strings.HasPrefix(string(res.Body), "GET /page") {
+		t.Errorf("unexpected body %q", res.Body)
+	}
+
+	select {
+	case path := <-copies:
+		if path != "/page" {
+			t.Errorf("mirrored %s, want /page", path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the proxied request was not mirrored")
+	}
+
+	// Neither the 404 nor the return were mirrored
+	select {
+	case path := <-copies:
+		t.Errorf("unexpected copy of %s", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
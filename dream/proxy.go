@@ -0,0 +1,533 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"dreamproxy/proxyproto"
+	"dreamproxy/upstream"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_PROXY_CONNECT_TIMEOUT = 60 * time.Second
+	DEFAULT_PROXY_SEND_TIMEOUT    = 60 * time.Second
+	DEFAULT_PROXY_READ_TIMEOUT    = 60 * time.Second
+)
+
+// Client credentials, never sent to another host when following a redirect
+var CROSS_HOST_STRIPPED_HEADERS = []string{
+	"authorization",
+	"proxy-authorization",
+	"cookie",
+}
+
+// Upstream response headers dropped unless listed in proxy_pass_header
+var DEFAULT_HIDDEN_HEADERS = []string{
+	"date",
+	"server",
+	"x-pad",
+	"x-accel-expires",
+	"x-accel-redirect",
+	"x-accel-limit-rate",
+	"x-accel-buffering",
+	"x-accel-charset",
+}
+
+// proxyTarget is either an upstream group or a single origin server
+type proxyTarget struct {
+	group *upstream.Upstream
+	host  string
+	port  int
+
+	// Host part of proxy_pass as written, e.g. "localhost:8000" or an
+	// upstream name, "localhost" for sockets
+	authority string
+
+	// Path of proxy_pass replacing the location prefix, empty to pass the
+	// request URI unchanged
+	uri string
+
+	// Set by an https:// proxy_pass
+	tls bool
+}
+
+// resolveProxyTarget tells an upstream group from a single server, a
+// proxy_pass without port may name a group
+func resolveProxyTarget(pass *config.ProxyTarget) proxyTarget {
+	target := proxyTarget{
+		host:      pass.Host,
+		port:      pass.Port,
+		authority: pass.Authority,
+		uri:       pass.URI,
+		tls:       pass.Scheme == "https",
+	}
+
+	// proxy_pass may name an upstream group instead of a host
+	if !pass.ExplicitPort && !http.IsUnixAddress(pass.Host) {
+		target.group = upstream.Lookup(pass.Host)
+	}
+
+	return target
+}
+
+// proxyTransport sets how the location reaches the target: timeouts,
+// PROXY protocol and TLS
+func (session *ClientSession) proxyTransport(location config.Location, target proxyTarget) (http.Transport, error) {
+	transport := http.Transport{
+		Timeouts: proxyTimeouts(location),
+	}
+
+	if target.group != nil && target.group.ProxyProtocol {
+		transport.ProxyProtocol = session.proxyProtocolHeader()
+	}
+
+	if target.tls {
+		tls_cfg, err := upstreamTLSConfig(location.ProxySSL, proxyServerName(target))
+		if err != nil {
+			return transport, err
+		}
+		transport.TLS = tls_cfg
+	}
+
+	return transport, nil
+}
+
+// proxyServerName is the proxy_pass host without its port, the name sent
+// in SNI and verified in the upstream certificate by default
+func proxyServerName(target proxyTarget) string {
+	if target.group != nil || http.IsUnixAddress(target.host) {
+		return target.authority
+	}
+	return target.host
+}
+
+// proxyRequest passes the request to the target. When every attempt
+// failed without a response the client gets a 502, or a 504 on timeout.
+func (session *ClientSession) proxyRequest(req *http.HttpReq, location config.Location, target_uri string, target proxyTarget, req_log *logger.RequestLog) *http.HttpRes {
+	res, err := session.fetchUpstream(req, location, target_uri, target, req_log)
+
+	if err != nil {
+		return upstreamErrorRes(err)
+	}
+
+	return res
+}
+
+func upstreamErrorRes(err error) *http.HttpRes {
+	if http.IsTimeout(err) {
+		return http.NewErrorRes(http.StatusGatewayTimeout)
+	}
+	return http.NewErrorRes(http.StatusBadGateway)
+}
+
+// fetchUpstream passes the request to the target and prepares the
+// response for the client
+func (session *ClientSession) fetchUpstream(req *http.HttpReq, location config.Location, target_uri string, target proxyTarget, req_log *logger.RequestLog) (*http.HttpRes, error) {
+	res, origins, err := session.fetchOrigin(req, location, target_uri, target, req_log)
+
+	if err != nil {
+		return nil, err
+	}
+
+	session.clientUpstreamRes(res, req, location, target, origins, req_log)
+
+	return res, nil
+}
+
+// clientUpstreamRes applies proxy_hide_header and proxy_redirect to an
+// upstream response, origins being the ones of the server that sent it
+func (session *ClientSession) clientUpstreamRes(res *http.HttpRes, req *http.HttpReq, location config.Location, target proxyTarget, origins []string, req_log *logger.RequestLog) {
+	vars := session.requestVariables(req, req_log.Request.ID)
+	vars["proxy_host"] = target.authority
+
+	hideProxyHeaders(res.Headers, location)
+	rewriteRedirects(res.Headers, location, origins, proxyRedirectBase(location, target), vars)
+}
+
+// fetchOrigin passes the request to the target, moving on to the next
+// upstream server according to proxy_next_upstream. The error is the one
+// of the last attempt when none got a response. The last upstream tried
+// and its latency are recorded in the request log. Returns the response
+// as sent by the upstream and the origins of the server that sent it.
+func (session *ClientSession) fetchOrigin(req *http.HttpReq, location config.Location, target_uri string, target proxyTarget, req_log *logger.RequestLog) (*http.HttpRes, []string, error) {
+	var res *http.HttpRes
+
+	transport, err := session.proxyTransport(location, target)
+
+	if err != nil {
+		logUpstreamFailure(req, req_log, nil, err, false)
+		return nil, nil, err
+	}
+
+	conditions := location.NextUpstream
+	if conditions == nil {
+		conditions = []string{"error", "timeout"}
+	}
+
+	upstream_req := *req
+	upstream_req.Headers = maps.Clone(req.Headers)
+
+	http.RemoveHopByHopHeaders(upstream_req.Headers)
+	upstream_req.SetForwardedHeaders(session.RemoteAddress, session.ClientIP, req.Headers["host"], location.AddForwarded)
+
+	vars := session.requestVariables(req, req_log.Request.ID)
+	vars["proxy_host"] = target.authority
+
+	setProxyHeaders(upstream_req.Headers, location, vars)
+
+	// Keep the upstream connection open for reuse whatever the client asked for
+	headers := upstream_req.Headers
+	headers["connection"] = "keep-alive"
+
+	start := time.Now()
+	tried := []*upstream.Server{}
+	origin_host, origin_port := target.host, target.port
+
+	for attempt := 1; ; attempt++ {
+		var server *upstream.Server
+
+		if target.group != nil {
+			next, next_err := target.group.Next(tried...)
+
+			if next_err != nil {
+				// Keep the outcome of the previous attempt, if any
+				if attempt == 1 {
+					err = next_err
+				}
+				break
+			}
+
+			server = next
+			tried = append(tried, server)
+			origin_host, origin_port = server.Host, server.Port
+			transport.Conns = server.Conns
+		}
+
+		upstream_start := time.Now()
+
+		res, err = http.MakeRequest(req.Method, origin_host, origin_port, target_uri, http.RequestConfig{
+			Headers:   headers,
+			Body:      req.Body,
+			Transport: transport,
+		})
+
+		req_log.Trace.UpstreamIP = http.Address(origin_host, origin_port)
+		req_log.Trace.UpstreamLatencyMS = time.Since(upstream_start).Milliseconds()
+
+		if server != nil {
+			reportUpstreamResult(server, res, err)
+		}
+
+		// A single origin has no next server to try
+		retry := target.group != nil && shouldRetry(conditions, req.Method, res, err)
+
+		if location.NextUpstreamTries > 0 && attempt >= location.NextUpstreamTries {
+			retry = false
+		}
+
+		if location.NextUpstreamTimeout > 0 && time.Since(start) >= location.NextUpstreamTimeout {
+			retry = false
+		}
+
+		if err != nil || retry {
+			logUpstreamFailure(req, req_log, res, err, retry)
+		}
+
+		if !retry {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if location.FollowRedirects > 0 {
+		res, origin_host, origin_port, err = followRedirects(upstream_req, res, origin_host, origin_port, target_uri, transport, location.FollowRedirects, location.ProxySetHeaders)
+
+		if err != nil {
+			logUpstreamFailure(req, req_log, res, err, false)
+			return nil, nil, err
+		}
+	}
+
+	res.SetReverseProxyHeaders()
+
+	return res, proxyOrigins(target, origin_host, origin_port), nil
+}
+
+// followRedirects requests the Location of upstream redirects instead of
+// passing them to the client, at most max times. The last redirect is
+// passed through when the limit is reached, on loops and for locations
+// that cannot be followed (another scheme, or another host over https).
+// Credentials and the proxy_set_header values are not sent to another
+// host. Returns the final response and the server that sent it.
+func followRedirects(req http.HttpReq, res *http.HttpRes, host string, port int, target_uri string, transport http.Transport, max int, set_headers []config.Header) (*http.HttpRes, string, int, error) {
+	authority := net.JoinHostPort(host, strconv.Itoa(port))
+	if http.IsUnixAddress(host) {
+		authority = "localhost"
+	}
+
+	scheme, default_port := "http", 80
+	if transport.TLS != nil {
+		scheme, default_port = "https", 443
+	}
+
+	current, err := url.Parse(scheme + "://" + authority + target_uri)
+	if err != nil {
+		return res, host, port, nil
+	}
+
+	method := req.Method
+	body := req.Body
+	headers := maps.Clone(req.Headers)
+	visited := []string{current.String()}
+
+	for hops := 0; hops < max && http.IsRedirect(res.Status); hops++ {
+		next, err := current.Parse(res.Headers["location"])
+		if err != nil || res.Headers["location"] == "" || next.Scheme != scheme {
+			break
+		}
+
+		if slices.Contains(visited, next.String()) {
+			break
+		}
+
+		next_host, next_port := host, port
+
+		if next.Host != current.Host {
+			// The TLS settings hold the name verified for our upstream only
+			if transport.TLS != nil {
+				break
+			}
+
+			next_host, next_port = next.Hostname(), default_port
+			if next.Port() != "" {
+				if next_port, err = strconv.Atoi(next.Port()); err != nil {
+					break
+				}
+			}
+		}
+
+		// 303 asks for a GET, and clients do the same for a POST on 301 and 302
+		if (res.Status == http.StatusSeeOther && method != "HEAD") ||
+			((res.Status == http.StatusMovedPermanently || res.Status == http.StatusFound) && method == "POST") {
+			method = "GET"
+			body = nil
+			delete(headers, "content-length")
+			delete(headers, "content-type")
+		}
+
+		if next.Host != current.Host {
+			for _, name := range CROSS_HOST_STRIPPED_HEADERS {
+				delete(headers, name)
+			}
+			for _, header := range set_headers {
+				delete(headers, header.Name)
+			}
+
+			headers["host"] = next.Host
+
+			// The PROXY protocol header and max_conns are meant for our upstream only
+			transport.ProxyProtocol = nil
+			transport.Conns = nil
+		}
+
+		res, err = http.MakeRequest(method, next_host, next_port, next.RequestURI(), http.RequestConfig{
+			Headers:   headers,
+			Body:      body,
+			Transport: transport,
+		})
+
+		if err != nil {
+			return nil, host, port, err
+		}
+
+		visited = append(visited, next.String())
+		current = next
+		host, port = next_host, next_port
+	}
+
+	return res, host, port, nil
+}
+
+// proxyOrigins lists the URLs the upstream may use to refer to itself in
+// redirects: the proxy_pass host and the server that answered, followed by
+// the proxy_pass URI
+func proxyOrigins(target proxyTarget, host string, port int) []string {
+	origins := []string{}
+
+	for _, authority := range []string{target.authority, http.Address(host, port)} {
+		origins = append(origins, "http://"+authority+target.uri, "https://"+authority+target.uri)
+	}
+
+	// Default ports are usually left out
+	switch port {
+	case 80:
+		origins = append(origins, "http://"+host+target.uri)
+	case 443:
+		origins = append(origins, "https://"+host+target.uri)
+	}
+
+	return origins
+}
+
+// proxyRedirectBase is what the default proxy_redirect puts in place of
+// the proxied URL: the location prefix when proxy_pass replaced it
+func proxyRedirectBase(location config.Location, target proxyTarget) string {
+	if target.uri == "" {
+		return ""
+	}
+	return location.Path
+}
+
+// setProxyHeaders applies proxy_set_host and proxy_set_header to the
+// headers sent upstream
+func setProxyHeaders(headers map[string]string, location config.Location, vars map[string]string) {
+	switch location.ProxySetHost {
+	case "", "off":
+	case "on":
+		headers["host"] = vars["proxy_host"]
+	default:
+		headers["host"] = interpolate(location.ProxySetHost, vars)
+	}
+
+	for _, header := range location.ProxySetHeaders {
+		value := interpolate(header.Value, vars)
+
+		if value == "" {
+			delete(headers, header.Name)
+			continue
+		}
+
+		headers[header.Name] = value
+	}
+}
+
+// hideProxyHeaders drops the upstream response headers hidden by default or
+// by proxy_hide_header, unless proxy_pass_header lets them through
+func hideProxyHeaders(headers map[string]string, location config.Location) {
+	for _, name := range DEFAULT_HIDDEN_HEADERS {
+		if !slices.Contains(location.ProxyPassHeaders, name) {
+			delete(headers, name)
+		}
+	}
+
+	for _, name := range location.ProxyHideHeaders {
+		delete(headers, name)
+	}
+}
+
+// proxyProtocolHeader announces the client of the session to an upstream:
+// the one resolved by real_ip, else the one of the incoming PROXY header
+func (session *ClientSession) proxyProtocolHeader() []byte {
+	ip, port := session.ClientIP, session.RemotePort
+
+	if session.ProxyProtocolAddress != "" && (ip == session.RemoteAddress || ip == session.ProxyProtocolAddress) {
+		ip, port = session.ProxyProtocolAddress, session.ProxyProtocolPort
+	}
+
+	src_port, _ := strconv.Atoi(port)
+	src := &net.TCPAddr{IP: net.ParseIP(ip), Port: src_port}
+
+	dst, _ := session.Connection.LocalAddr().(*net.TCPAddr)
+
+	if src.IP == nil || dst == nil {
+		return proxyproto.FormatV1(nil, nil)
+	}
+
+	return proxyproto.FormatV1(src, dst)
+}
+
+func proxyTimeouts(location config.Location) http.Timeouts {
+	timeouts := http.Timeouts{
+		Connect: location.ConnectTimeout,
+		Send:    location.SendTimeout,
+		Read:    location.ReadTimeout,
+	}
+
+	if timeouts.Connect <= 0 {
+		timeouts.Connect = DEFAULT_PROXY_CONNECT_TIMEOUT
+	}
+	if timeouts.Send <= 0 {
+		timeouts.Send = DEFAULT_PROXY_SEND_TIMEOUT
+	}
+	if timeouts.Read <= 0 {
+		timeouts.Read = DEFAULT_PROXY_READ_TIMEOUT
+	}
+
+	return timeouts
+}
+
+// shouldRetry tells whether the outcome of an attempt matches one of the
+// proxy_next_upstream conditions. Non-idempotent requests are only retried
+// when nothing reached the upstream, unless non_idempotent is set.
+func shouldRetry(conditions []string, method string, res *http.HttpRes, err error) bool {
+	if slices.Contains(conditions, "off") {
+		return false
+	}
+
+	var connect_err *http.ConnectError
+	nothing_sent := errors.As(err, &connect_err)
+
+	if !nothing_sent && !http.IsIdempotent(method) && !slices.Contains(conditions, "non_idempotent") {
+		return false
+	}
+
+	if err != nil {
+		if http.IsTimeout(err) {
+			return slices.Contains(conditions, "timeout")
+		}
+		return slices.Contains(conditions, "error")
+	}
+
+	return slices.Contains(conditions, fmt.Sprintf("http_%d", res.Status))
+}
+
+// reportUpstreamResult feeds the passive health checks of an upstream server
+func reportUpstreamResult(server *upstream.Server, res *http.HttpRes, err error) {
+	switch {
+	case err != nil:
+		server.ReportFailure(err.Error())
+	case res.Status >= http.StatusInternalServerError:
+		server.ReportFailure(fmt.Sprintf("status %d", res.Status))
+	default:
+		server.ReportSuccess()
+	}
+}
+
+func logUpstreamFailure(req *http.HttpReq, req_log *logger.RequestLog, res *http.HttpRes, err error, retry bool) {
+	msg := ""
+
+	if err != nil {
+		msg = err.Error()
+	} else {
+		msg = fmt.Sprintf("upstream responded %d", res.Status)
+	}
+
+	if retry {
+		msg += ", trying next upstream"
+	}
+
+	// Failures of mirrored copies are reported with the mirror
+	service := logger.UPSTREAM
+	if req_log.Service == string(logger.MIRROR) {
+		service = logger.MIRROR
+	}
+
+	log := logger.NewRequestLog(service, logger.WARN, logger.UPSTREAM_ERROR, msg)
+	log.Request.Method = req.Method
+	log.Request.Path = req.Target
+	log.Request.Host = req.Headers["host"]
+	log.Trace = req_log.Trace
+
+	fmt.Println(log.ToText())
+}
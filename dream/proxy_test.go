@@ -0,0 +1,620 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"dreamproxy/proxyproto"
+	"dreamproxy/upstream"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startOrigin serves handler, returning its host and port
+func startOrigin(t *testing.T, handler nethttp.HandlerFunc) (string, int) {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	port_num, _ := strconv.Atoi(port)
+
+	return host, port_num
+}
+
+// echoRequest answers with what the redirect target received
+func echoRequest(w nethttp.ResponseWriter, r *nethttp.Request) {
+	body, _ := io.ReadAll(r.Body)
+	fmt.Fprintf(w, "%s %s host=%s auth=%s cookie=%s token=%s body=%s",
+		r.Method, r.URL.Path, r.Host, r.Header.Get("Authorization"), r.Header.Get("Cookie"), r.Header.Get("X-Token"), body)
+}
+
+func redirectRes(status http.StatusCode, location string) *http.HttpRes {
+	res := http.NewErrorRes(status)
+	res.Headers["location"] = location
+	return res
+}
+
+func TestFollowRedirects(t *testing.T) {
+	other_host, other_port := startOrigin(t, echoRequest)
+	other := net.JoinHostPort(other_host, strconv.Itoa(other_port))
+
+	var host string
+	var port int
+	host, port = startOrigin(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/hop/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+			nethttp.Redirect(w, r, fmt.Sprintf("/hop/%d", n+1), nethttp.StatusFound)
+		case r.URL.Path == "/loop":
+			nethttp.Redirect(w, r, "/start", nethttp.StatusFound)
+		default:
+			echoRequest(w, r)
+		}
+	})
+	self := net.JoinHostPort(host, strconv.Itoa(port))
+
+	set_headers := []config.Header{{Name: "x-token", Value: "$http_x_token"}}
+
+	tests := []struct {
+		name     string
+		method   string
+		res      *http.HttpRes
+		max      int
+		wantCode http.StatusCode
+		wantBody string
+	}{
+		{
+			name:     "Relative location",
+			method:   "GET",
+			res:      redirectRes(http.StatusFound, "/dest"),
+			max:      3,
+			wantCode: http.StatusOK,
+			wantBody: "GET /dest host=" + self + " auth=Bearer s3cret cookie=sid=1 token=t0k body=",
+		},
+		{
+			name:     "Absolute location on the same host",
+			method:   "GET",
+			res:      redirectRes(http.StatusMovedPermanently, "http://"+self+"/dest"),
+			max:      3,
+			wantCode: http.StatusOK,
+			wantBody: "GET /dest host=" + self + " auth=Bearer s3cret cookie=sid=1 token=t0k body=",
+		},
+		{
+			name:     "303 turns a POST into a GET",
+			method:   "POST",
+			res:      redirectRes(http.StatusSeeOther, "/dest"),
+			max:      3,
+			wantCode: http.StatusOK,
+			wantBody: "GET /dest host=" + self + " auth=Bearer s3cret cookie=sid=1 token=t0k body=",
+		},
+		{
+			name:     "307 keeps the method and body",
+			method:   "POST",
+			res:      redirectRes(http.StatusTemporaryRedirect, "/dest"),
+			max:      3,
+			wantCode: http.StatusOK,
+			wantBody: "POST /dest host=" + self + " auth=Bearer s3cret cookie=sid=1 token=t0k body=data",
+		},
+		{
+			name:     "Another host gets no credentials",
+			method:   "GET",
+			res:      redirectRes(http.StatusFound, "http://"+other+"/dest"),
+			max:      3,
+			wantCode: http.StatusOK,
+			wantBody: "GET /dest host=" + other + " auth= cookie= token= body=",
+		},
+		{
+			name:     "Limit passes the last redirect through",
+			method:   "GET",
+			res:      redirectRes(http.StatusFound, "/hop/1"),
+			max:      2,
+			wantCode: http.StatusFound,
+		},
+		{
+			name:     "Loop passes the redirect through",
+			method:   "GET",
+			res:      redirectRes(http.StatusFound, "/loop"),
+			max:      5,
+			wantCode: http.StatusFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := http.HttpReq{
+				Method:  tt.method,
+				Target:  "/start",
+				Version: "1.1",
+				Headers: map[string]string{
+					"host":           self,
+					"authorization":  "Bearer s3cret",
+					"cookie":         "sid=1",
+					"x-token":        "t0k",
+					"content-length": "4",
+					"content-type":   "text/plain",
+				},
+				Body: []byte("data"),
+			}
+
+			if tt.method == "GET" {
+				req.Body = nil
+				delete(req.Headers, "content-length")
+				delete(req.Headers, "content-type")
+			}
+
+			transport := http.Transport{Timeouts: http.Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}}
+
+			res, _, _, err := followRedirects(req, tt.res, host, port, "/start", transport, tt.max, set_headers)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Status != tt.wantCode {
+				t.Fatalf("status = %d, want %d (%q)", res.Status, tt.wantCode, res.Headers["location"])
+			}
+
+			if tt.wantBody != "" && string(res.Body) != tt.wantBody {
+				t.Errorf("body = %q\nwant %q", res.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	defaults := []string{"error", "timeout"}
+	connect_err := &http.ConnectError{Err: syscall.ECONNREFUSED}
+	connect_timeout := &http.ConnectError{Err: os.ErrDeadlineExceeded}
+	read_err := fmt.Errorf("reading response: %w", syscall.ECONNRESET)
+	read_timeout := fmt.Errorf("reading response: %w", os.ErrDeadlineExceeded)
+
+	tests := []struct {
+		name       string
+		conditions []string
+		method     string
+		status     http.StatusCode
+		err        error
+		want       bool
+	}{
+		{"Error", defaults, "GET", 0, read_err, true},
+		{"Error not listed", []string{"timeout"}, "GET", 0, read_err, false},
+		{"Timeout", defaults, "GET", 0, read_timeout, true},
+		{"Timeout not listed", []string{"error"}, "GET", 0, read_timeout, false},
+		{"Connect timeout", []string{"timeout"}, "GET", 0, connect_timeout, true},
+		{"Listed status", []string{"http_502", "http_503"}, "GET", http.StatusServiceUnavailable, nil, true},
+		{"Status not listed", []string{"http_502"}, "GET", http.StatusServiceUnavailable, nil, false},
+		{"Status by default", defaults, "GET", http.StatusInternalServerError, nil, false},
+		{"Off", []string{"off"}, "GET", 0, connect_err, false},
+		{"POST after a connect error", defaults, "POST", 0, connect_err, true},
+		{"POST after a connect timeout", defaults, "POST", 0, connect_timeout, true},
+		{"POST after a read error", defaults, "POST", 0, read_err, false},
+		{"POST after a read timeout", defaults, "POST", 0, read_timeout, false},
+		{"POST with a listed status", []string{"http_503"}, "POST", http.StatusServiceUnavailable, nil, false},
+		{"POST with non_idempotent", []string{"error", "non_idempotent"}, "POST", 0, read_err, true},
+		{"PUT is idempotent", defaults, "PUT", 0, read_err, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res *http.HttpRes
+			if tt.err == nil {
+				res = http.NewErrorRes(tt.status)
+			}
+
+			if got := shouldRetry(tt.conditions, tt.method, res, tt.err); got != tt.want {
+				t.Errorf("shouldRetry(%v, %s, %d, %v) = %v, want %v", tt.conditions, tt.method, tt.status, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// startHungOrigin accepts connections and never answers, counting them
+func startHungOrigin(t *testing.T) (string, *atomic.Int32) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted := &atomic.Int32{}
+	conns := make(chan net.Conn, 16)
+
+	t.Cleanup(func() {
+		ln.Close()
+		close(conns)
+		for conn := range conns {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			conns <- conn
+		}
+	}()
+
+	return ln.Addr().String(), accepted
+}
+
+// closedAddress returns an address nothing listens on
+func closedAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	return ln.Addr().String()
+}
+
+func TestFetchUpstreamNextUpstream(t *testing.T) {
+	hits := map[string]*atomic.Int32{}
+
+	countingOrigin := func(name string, status int) string {
+		hits[name] = &atomic.Int32{}
+		host, port := startOrigin(t, func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			hits[name].Add(1)
+			w.WriteHeader(status)
+			fmt.Fprint(w, name)
+		})
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	unavailable := countingOrigin("unavailable", 503)
+	ok := countingOrigin("ok", 200)
+	hung_a, hung_a_accepted := startHungOrigin(t)
+	hung_b, hung_b_accepted := startHungOrigin(t)
+	closed_a, closed_b := closedAddress(t), closedAddress(t)
+
+	timeouts := config.Location{ConnectTimeout: time.Second, SendTimeout: time.Second, ReadTimeout: 300 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		servers  []string
+		location config.Location
+		method   string
+		want     http.StatusCode
+		wantBody string
+		wantHits map[string]int32
+		check    func(t *testing.T, elapsed time.Duration)
+	}{
+		{
+			name:     "Next server after an error",
+			servers:  []string{closed_a, ok},
+			location: timeouts,
+			method:   "GET",
+			want:     http.StatusOK,
+			wantBody: "ok",
+			wantHits: map[string]int32{"ok": 1},
+		},
+		{
+			name:     "Next server on a listed status",
+			servers:  []string{unavailable, ok},
+			location: config.Location{NextUpstream: []string{"http_503"}, ReadTimeout: time.Second},
+			method:   "GET",
+			want:     http.StatusOK,
+			wantBody: "ok",
+			wantHits: map[string]int32{"unavailable": 1, "ok": 1},
+		},
+		{
+			name:     "POST is not retried once sent",
+			servers:  []string{unavailable, ok},
+			location: config.Location{NextUpstream: []string{"http_503"}, ReadTimeout: time.Second},
+			method:   "POST",
+			want:     http.StatusServiceUnavailable,
+			wantBody: "unavailable",
+			wantHits: map[string]int32{"unavailable": 1, "ok": 0},
+		},
+		{
+			name:     "POST is retried after a connect error",
+			servers:  []string{closed_b, ok},
+			location: timeouts,
+			method:   "POST",
+			want:     http.StatusOK,
+			wantBody: "ok",
+			wantHits: map[string]int32{"ok": 1},
+		},
+		{
+			name:     "Tries limit the attempts",
+			servers:  []string{unavailable, ok},
+			location: config.Location{NextUpstream: []string{"http_503"}, NextUpstreamTries: 1, ReadTimeout: time.Second},
+			method:   "GET",
+			want:     http.StatusServiceUnavailable,
+			wantBody: "unavailable",
+			wantHits: map[string]int32{"unavailable": 1, "ok": 0},
+		},
+		{
+			name:     "Every server failing gives a 502",
+			servers:  []string{closed_a, closed_b},
+			location: timeouts,
+			method:   "GET",
+			want:     http.StatusBadGateway,
+		},
+		{
+			name:     "Timeout stops the retries with a 504",
+			servers:  []string{hung_a, hung_b},
+			location: config.Location{ConnectTimeout: time.Second, ReadTimeout: 300 * time.Millisecond, NextUpstreamTimeout: 100 * time.Millisecond},
+			method:   "GET",
+			want:     http.StatusGatewayTimeout,
+			check: func(t *testing.T, elapsed time.Duration) {
+				if n := hung_a_accepted.Load() + hung_b_accepted.Load(); n != 1 {
+					t.Errorf("expected 1 attempt, got %d", n)
+				}
+				if elapsed > 600*time.Millisecond {
+					t.Errorf("answered after %s", elapsed)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, count := range hits {
+				count.Store(0)
+			}
+
+			servers := []config.UpstreamServer{}
+			for _, address := range tt.servers {
+				servers = append(servers, config.UpstreamServer{Address: address})
+			}
+
+			group, err := upstream.NewUpstream(config.Upstream{Name: "backend", Servers: servers})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := &http.HttpReq{
+				Method:  tt.method,
+				Target:  "/",
+				Version: "1.1",
+				Headers: map[string]string{"host": "example.com"},
+			}
+			if tt.method == "POST" {
+				req.Headers["content-length"] = "0"
+			}
+
+			target := proxyTarget{group: group, authority: "backend"}
+			req_log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
+			conn, _ := net.Pipe()
+			defer conn.Close()
+			session := ClientSession{RemoteAddress: "192.0.2.1", ClientIP: "192.0.2.1", Connection: conn}
+
+			start := time.Now()
+			res := session.proxyRequest(req, tt.location, "/", target, &req_log)
+			elapsed := time.Since(start)
+
+			if res.Status != tt.want {
+				t.Fatalf("status = %d, want %d", res.Status, tt.want)
+			}
+			if tt.wantBody != "" && string(res.Body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", res.Body, tt.wantBody)
+			}
+			for name, want := range tt.wantHits {
+				if got := hits[name].Load(); got != want {
+					t.Errorf("%s hit %d times, want %d", name, got, want)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, elapsed)
+			}
+		})
+	}
+}
+
+func TestSetProxyHeaders(t *testing.T) {
+	vars := map[string]string{"proxy_host": "backend:8000", "host": "example.com", "http_x_token": "t0k"}
+
+	tests := []struct {
+		name     string
+		location config.Location
+		want     map[string]string
+	}{
+		{
+			name:     "proxy_set_host off keeps the client Host",
+			location: config.Location{ProxySetHost: "off"},
+			want:     map[string]string{"host": "example.com:8080"},
+		},
+		{
+			name:     "Default keeps the client Host",
+			location: config.Location{},
+			want:     map[string]string{"host": "example.com:8080"},
+		},
+		{
+			name:     "proxy_set_host on sends the proxy_pass host",
+			location: config.Location{ProxySetHost: "on"},
+			want:     map[string]string{"host": "backend:8000"},
+		},
+		{
+			name:     "Explicit proxy_set_host",
+			location: config.Location{ProxySetHost: "api.$host"},
+			want:     map[string]string{"host": "api.example.com"},
+		},
+		{
+			name: "proxy_set_header",
+			location: config.Location{ProxySetHeaders: []config.Header{
+				{Name: "x-token", Value: "Bearer ${http_x_token}"},
+				{Name: "x-origin", Value: "$host"},
+			}},
+			want: map[string]string{"x-token": "Bearer t0k", "x-origin": "example.com"},
+		},
+		{
+			name: "Empty value removes the header",
+			location: config.Location{ProxySetHeaders: []config.Header{
+				{Name: "accept-encoding", Value: ""},
+				{Name: "x-token", Value: "$unknown"},
+			}},
+			want: map[string]string{"accept-encoding": "", "x-token": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{"host": "example.com:8080", "accept-encoding": "gzip", "x-token": "t0k"}
+			setProxyHeaders(headers, tt.location, vars)
+
+			for name, want := range tt.want {
+				got, ok := headers[name]
+				if want == "" && ok {
+					t.Errorf("%s = %q, expected it removed", name, got)
+				} else if got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHideProxyHeaders(t *testing.T) {
+	headers := map[string]string{
+		"server":           "upstream",
+		"date":             "Mon, 19 Oct 2026 00:00:00 GMT",
+		"x-accel-redirect": "/internal",
+		"x-powered-by":     "php",
+		"content-type":     "text/html",
+	}
+
+	hideProxyHeaders(headers, config.Location{
+		ProxyPassHeaders: []string{"server"},
+		ProxyHideHeaders: []string{"x-powered-by"},
+	})
+
+	want := map[string]string{"server": "upstream", "content-type": "text/html"}
+	if !maps.Equal(headers, want) {
+		t.Errorf("got %v, want %v", headers, want)
+	}
+}
+
+func TestProxyReadTimeout(t *testing.T) {
+	address, accepted := startHungOrigin(t)
+	host, port_str, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(port_str)
+
+	location := config.Location{ConnectTimeout: time.Second, SendTimeout: time.Second, ReadTimeout: 300 * time.Millisecond}
+	target := proxyTarget{host: host, port: port, authority: address}
+
+	req := &http.HttpReq{Method: "GET", Target: "/", Version: "1.1", Headers: map[string]string{"host": "example.com"}}
+	req_log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
+
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	session := ClientSession{RemoteAddress: "192.0.2.1", ClientIP: "192.0.2.1", Connection: conn}
+
+	start := time.Now()
+	res := session.proxyRequest(req, location, "/", target, &req_log)
+	elapsed := time.Since(start)
+
+	if res.Status != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", res.Status)
+	}
+	if elapsed < 300*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Errorf("answered after %s, proxy_read_timeout is 300ms", elapsed)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected 1 upstream connection, got %d", n)
+	}
+}
+
+func TestProxyProtocolClientAddress(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Answers with the client announced by the PROXY header
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+
+				header, err := proxyproto.ReadHeader(c)
+				if err != nil {
+					return
+				}
+				if _, err := http.ReadFullHttpMessage(c); err != nil {
+					return
+				}
+
+				source := "unknown"
+				if header.Source != nil {
+					source = header.Source.String()
+				}
+				fmt.Fprintf(c, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(source), source)
+			}(conn)
+		}
+	}()
+
+	// No set_real_ip_from nor real_ip_header
+	cfg := config.ParseDreamFile(`
+upstream pp_backend {
+  server ` + backend.Addr().String() + `
+  proxy_protocol on
+}
+
+servers {
+  server {
+    name example.com
+    listen 8080 proxy_protocol
+
+    location / {
+      proxy_pass http://pp_backend
+    }
+  }
+}
+`)
+	upstream.Init(cfg.Upstreams)
+
+	// The balancer's connection, which announced 203.0.113.7:51000
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	session := NewClientSession(conn)
+	session.ProxyProtocolAddress = "203.0.113.7"
+	session.ProxyProtocolPort = "51000"
+
+	req := &http.HttpReq{Method: "GET", Scheme: "http", Target: "/", Version: "1.1", Headers: map[string]string{"host": "example.com"}}
+	req_log := logger.NewRequestLog(logger.DREAM_SERVER, logger.INFO, logger.REQUEST, "")
+
+	res, err := session.HandleRequest(req, cfg.Servers, &req_log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(res.Body) != "203.0.113.7:51000" {
+		t.Errorf("backend saw %q, want 203.0.113.7:51000", res.Body)
+	}
+}
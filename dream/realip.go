@@ -0,0 +1,75 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+const DEFAULT_REAL_IP_HEADER = "x-forwarded-for"
+
+// real_ip_header value taking the address from the PROXY protocol header
+const REAL_IP_PROXY_PROTOCOL = "proxy_protocol"
+
+// resolveClientIP returns the address of the client as reported by a
+// trusted proxy in front of us, or the peer address when the peer is not
+// listed in set_real_ip_from
+func resolveClientIP(peer string, proxy_protocol_addr string, headers map[string]string, server_cfg config.Server) string {
+	if !isTrustedProxy(peer, server_cfg.RealIPFrom) {
+		return peer
+	}
+
+	header := server_cfg.RealIPHeader
+	if header == "" {
+		header = DEFAULT_REAL_IP_HEADER
+	}
+
+	value := headers[header]
+
+	if header == REAL_IP_PROXY_PROTOCOL {
+		value = proxy_protocol_addr
+	}
+
+	if value == "" {
+		return peer
+	}
+
+	// Other headers hold a single address, X-Forwarded-For a chain where
+	// every proxy appended the address it received the request from
+	addrs := []string{}
+	for _, addr := range strings.Split(value, ",") {
+		addrs = append(addrs, strings.TrimSpace(addr))
+	}
+
+	client := addrs[len(addrs)-1]
+
+	if server_cfg.RealIPRecursive {
+		// Walk back the chain until the first hop we do not trust
+		i := len(addrs) - 1
+		for i > 0 && isTrustedProxy(addrs[i], server_cfg.RealIPFrom) {
+			i--
+		}
+		client = addrs[i]
+	}
+
+	addr, err := netip.ParseAddr(client)
+	if err != nil {
+		return peer
+	}
+
+	return addr.Unmap().String()
+}
+
+func isTrustedProxy(ip string, trusted []netip.Prefix) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+
+	return slices.ContainsFunc(trusted, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
@@ -0,0 +1,82 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"net/netip"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.1/32"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+
+	tests := []struct {
+		name       string
+		peer       string
+		proxy_addr string
+		headers    map[string]string
+		cfg        config.Server
+		want       string
+	}{
+		{
+			name:    "Untrusted peer is the client",
+			peer:    "192.0.2.1",
+			headers: map[string]string{"x-forwarded-for": "1.2.3.4"},
+			cfg:     config.Server{RealIPFrom: trusted},
+			want:    "192.0.2.1",
+		},
+		{
+			name:    "Trusted peer, last hop",
+			peer:    "127.0.0.1",
+			headers: map[string]string{"x-forwarded-for": "1.2.3.4, 10.0.0.2"},
+			cfg:     config.Server{RealIPFrom: trusted},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "Trusted peer, recursive",
+			peer:    "127.0.0.1",
+			headers: map[string]string{"x-forwarded-for": "5.6.7.8, 1.2.3.4, 10.0.0.2"},
+			cfg:     config.Server{RealIPFrom: trusted, RealIPRecursive: true},
+			want:    "1.2.3.4",
+		},
+		{
+			name:    "Recursive, every hop trusted",
+			peer:    "127.0.0.1",
+			headers: map[string]string{"x-forwarded-for": "10.0.0.3, 10.0.0.2"},
+			cfg:     config.Server{RealIPFrom: trusted, RealIPRecursive: true},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "X-Real-IP header",
+			peer:    "10.1.1.1",
+			headers: map[string]string{"x-real-ip": "2001:db8::1"},
+			cfg:     config.Server{RealIPFrom: trusted, RealIPHeader: "x-real-ip"},
+			want:    "2001:db8::1",
+		},
+		{
+			name:       "PROXY protocol address",
+			peer:       "10.1.1.1",
+			proxy_addr: "198.51.100.7",
+			headers:    map[string]string{"x-forwarded-for": "1.2.3.4"},
+			cfg:        config.Server{RealIPFrom: trusted, RealIPHeader: "proxy_protocol"},
+			want:       "198.51.100.7",
+		},
+		{
+			name:    "Garbage header value",
+			peer:    "127.0.0.1",
+			headers: map[string]string{"x-forwarded-for": "not-an-ip"},
+			cfg:     config.Server{RealIPFrom: trusted},
+			want:    "127.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveClientIP(tt.peer, tt.proxy_addr, tt.headers, tt.cfg); got != tt.want {
+				t.Errorf("resolveClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
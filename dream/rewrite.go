@@ -0,0 +1,128 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"maps"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Location searches allowed per request after rewrites, past it the
+// rewrites are assumed to loop
+const MAX_REWRITE_CYCLES = 10
+
+type rewriteResult struct {
+	path    string
+	args    string
+	changed bool
+
+	// Set by "break" to keep handling the request in the same location
+	stop bool
+
+	// Non zero when the client has to be redirected to path?args instead
+	redirect http.StatusCode
+}
+
+// applyRewrites runs the rewrites of a location against the decoded
+// request path. As in the replacement, a query in it replaces args unless
+// it ends with "?", which drops them.
+func applyRewrites(rewrites []config.Rewrite, path string, args string, vars map[string]string) rewriteResult {
+	result := rewriteResult{path: path, args: args}
+
+	for _, rewrite := range rewrites {
+		captures := rewrite.Regex.FindStringSubmatch(result.path)
+		if captures == nil {
+			continue
+		}
+
+		rewrite_vars := maps.Clone(vars)
+		for i, capture := range captures {
+			rewrite_vars[strconv.Itoa(i)] = capture
+		}
+
+		replacement := interpolate(rewrite.Replacement, rewrite_vars)
+
+		new_path, new_args, has_args := strings.Cut(replacement, "?")
+		switch {
+		case !has_args:
+		case new_args == "":
+			result.args = ""
+		case result.args != "":
+			result.args = new_args + "&" + result.args
+		default:
+			result.args = new_args
+		}
+
+		result.path = new_path
+		result.changed = true
+
+		switch {
+		case rewrite.Flag == "permanent":
+			result.redirect = http.StatusMovedPermanently
+		case rewrite.Flag == "redirect",
+			strings.HasPrefix(new_path, "http://"),
+			strings.HasPrefix(new_path, "https://"):
+			result.redirect = http.StatusFound
+		case rewrite.Flag == "break":
+			result.stop = true
+		}
+
+		if rewrite.Flag != "" || result.redirect != 0 {
+			break
+		}
+	}
+
+	return result
+}
+
+// findLocation returns the last location whose cleaned path prefixes the
+// cleaned request path, so "/static" matches "location /static/"
+func findLocation(locations []config.Location, req_path string) *config.Location {
+	var found *config.Location
+
+	clean_path := path.Clean(req_path)
+
+	for i := range locations {
+		// Does not support globbing yet
+		if strings.HasPrefix(clean_path, path.Clean(locations[i].Path)) {
+			found = &locations[i]
+		}
+	}
+
+	return found
+}
+
+// upstreamURI builds the request target sent to the upstream. The client
+// one is kept as is, encoding included, unless it was rewritten or
+// proxy_pass has a URI replacing the location prefix.
+func upstreamURI(raw_target string, path string, args string, rewritten bool, location config.Location, target proxyTarget) string {
+	raw_path, _, _ := strings.Cut(raw_target, "?")
+
+	if !rewritten && target.uri == "" {
+		return raw_target
+	}
+
+	uri := raw_path
+	if rewritten || !strings.HasPrefix(raw_path, location.Path) {
+		uri = (&url.URL{Path: path}).EscapedPath()
+	}
+
+	if target.uri != "" && strings.HasPrefix(uri, location.Path) {
+		uri = target.uri + strings.TrimPrefix(uri, location.Path)
+	} else if target.uri != "" && uri+"/" == location.Path {
+		// "/api" is matched by location /api/ as well
+		uri = strings.TrimSuffix(target.uri, "/")
+		if uri == "" {
+			uri = "/"
+		}
+	}
+
+	if args != "" {
+		uri += "?" + args
+	}
+
+	return uri
+}
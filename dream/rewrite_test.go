@@ -0,0 +1,165 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"regexp"
+	"testing"
+)
+
+func TestApplyRewrites(t *testing.T) {
+	vars := map[string]string{"host": "example.com"}
+
+	tests := []struct {
+		name     string
+		rewrites []config.Rewrite
+		path     string
+		args     string
+		want     rewriteResult
+	}{
+		{
+			name:     "No match",
+			rewrites: []config.Rewrite{{Regex: regexp.MustCompile(`^/old/`), Replacement: "/new/"}},
+			path:     "/other",
+			args:     "a=1",
+			want:     rewriteResult{path: "/other", args: "a=1"},
+		},
+		{
+			name:     "Captures keep the query",
+			rewrites: []config.Rewrite{{Regex: regexp.MustCompile(`^/item/(\d+)$`), Replacement: "/items/$1/show", Flag: "break"}},
+			path:     "/item/42",
+			args:     "a=1",
+			want:     rewriteResult{path: "/items/42/show", args: "a=1", changed: true, stop: true},
+		},
+		{
+			name:     "Replacement query is prepended",
+			rewrites: []config.Rewrite{{Regex: regexp.MustCompile(`^/u/(\w+)$`), Replacement: "/profile?user=$1"}},
+			path:     "/u/ana",
+			args:     "tab=2",
+			want:     rewriteResult{path: "/profile", args: "user=ana&tab=2", changed: true},
+		},
+		{
+			name:     "Trailing question mark drops the query",
+			rewrites: []config.Rewrite{{Regex: regexp.MustCompile(`^/a$`), Replacement: "/b?"}},
+			path:     "/a",
+			args:     "x=1",
+			want:     rewriteResult{path: "/b", changed: true},
+		},
+		{
+			name: "Rules chain until a flag",
+			rewrites: []config.Rewrite{
+				{Regex: regexp.MustCompile(`^/a$`), Replacement: "/b"},
+				{Regex: regexp.MustCompile(`^/b$`), Replacement: "/c", Flag: "last"},
+				{Regex: regexp.MustCompile(`^/c$`), Replacement: "/d"},
+			},
+			path: "/a",
+			want: rewriteResult{path: "/c", changed: true},
+		},
+		{
+			name:     "Absolute replacement redirects",
+			rewrites: []config.Rewrite{{Regex: regexp.MustCompile(`^/(.*)$`), Replacement: "https://$host/$1"}},
+			path:     "/x",
+			want:     rewriteResult{path: "https://example.com/x", changed: true, redirect: http.StatusFound},
+		},
+		{
+			name:     "Permanent",
+			rewrites: []config.Rewrite{{Regex: regexp.MustCompile(`^/old$`), Replacement: "/new", Flag: "permanent"}},
+			path:     "/old",
+			want:     rewriteResult{path: "/new", changed: true, redirect: http.StatusMovedPermanently},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyRewrites(tt.rewrites, tt.path, tt.args, vars); got != tt.want {
+				t.Errorf("applyRewrites() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamURI(t *testing.T) {
+	location := config.Location{Path: "/api/"}
+
+	tests := []struct {
+		name      string
+		raw       string
+		path      string
+		args      string
+		rewritten bool
+		target    proxyTarget
+		want      string
+	}{
+		{
+			name: "Unchanged, encoding kept",
+			raw:  "/api/a%2Fb?q=1",
+			path: "/api/a/b",
+			args: "q=1",
+			want: "/api/a%2Fb?q=1",
+		},
+		{
+			name:   "Prefix replaced",
+			raw:    "/api/users/a%20b?q=1",
+			path:   "/api/users/a b",
+			args:   "q=1",
+			target: proxyTarget{uri: "/v2/"},
+			want:   "/v2/users/a%20b?q=1",
+		},
+		{
+			name:   "Location path without its slash",
+			raw:    "/api?q=1",
+			path:   "/api",
+			args:   "q=1",
+			target: proxyTarget{uri: "/v2/"},
+			want:   "/v2?q=1",
+		},
+		{
+			name:      "Rewritten path",
+			raw:       "/api/old?q=1",
+			path:      "/api/new page",
+			args:      "q=1",
+			rewritten: true,
+			want:      "/api/new%20page?q=1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := upstreamURI(tt.raw, tt.path, tt.args, tt.rewritten, location, tt.target); got != tt.want {
+				t.Errorf("upstreamURI() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindLocation(t *testing.T) {
+	locations := []config.Location{{Path: "/"}, {Path: "/static/"}, {Path: "/api"}}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"/static", "/static/"},
+		{"/static/", "/static/"},
+		{"/static/css/site.css", "/static/"},
+		{"/api/users", "/api"},
+		{"/other", "/"},
+	}
+
+	for _, tt := range tests {
+		if got := findLocation(locations, tt.path); got == nil || got.Path != tt.want {
+			t.Errorf("findLocation(%q) = %v, want %s", tt.path, got, tt.want)
+		}
+	}
+
+	// The last location matching wins
+	reversed := []config.Location{{Path: "/static/"}, {Path: "/"}}
+	if got := findLocation(reversed, "/static/site.css"); got.Path != "/" {
+		t.Errorf("findLocation() = %s, want /", got.Path)
+	}
+
+	if got := findLocation([]config.Location{{Path: "/static/"}}, "/other"); got != nil {
+		t.Errorf("findLocation() = %s, want none", got.Path)
+	}
+}
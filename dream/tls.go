@@ -0,0 +1,133 @@
+package dream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"dreamproxy/config"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Settings of locations without proxy_ssl_* directives
+var DEFAULT_PROXY_SSL = &config.ProxySSL{}
+
+type upstreamTLSKey struct {
+	ssl  *config.ProxySSL
+	name string
+}
+
+// Built once per location and upstream name, the pool keeps connections
+// apart per *tls.Config
+var upstreamTLSConfigs sync.Map
+
+// upstreamTLSConfig returns the client TLS configuration toward the
+// upstream known as proxy_host (the proxy_pass host)
+func upstreamTLSConfig(ssl *config.ProxySSL, proxy_host string) (*tls.Config, error) {
+	if ssl == nil {
+		ssl = DEFAULT_PROXY_SSL
+	}
+
+	key := upstreamTLSKey{ssl: ssl, name: proxy_host}
+
+	if cfg, ok := upstreamTLSConfigs.Load(key); ok {
+		return cfg.(*tls.Config), nil
+	}
+
+	cfg, err := newUpstreamTLSConfig(ssl, proxy_host)
+	if err != nil {
+		return nil, err
+	}
+
+	actual, _ := upstreamTLSConfigs.LoadOrStore(key, cfg)
+	return actual.(*tls.Config), nil
+}
+
+func newUpstreamTLSConfig(ssl *config.ProxySSL, proxy_host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: ssl.SkipVerify,
+	}
+
+	if ssl.TrustedCertificate != "" {
+		pem, err := os.ReadFile(ssl.TrustedCertificate)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", ssl.TrustedCertificate)
+		}
+	}
+
+	if ssl.Certificate != "" || ssl.CertificateKey != "" {
+		cert, err := tls.LoadX509KeyPair(ssl.Certificate, ssl.CertificateKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	switch ssl.ServerName {
+	case "", "on":
+		cfg.ServerName = proxy_host
+	case "off":
+		// Go sends the name it verifies, so without SNI the
+		// verification has to be done by hand
+		if !ssl.SkipVerify {
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyConnection = verifyPeer(cfg.RootCAs, proxy_host)
+		}
+	default:
+		cfg.ServerName = ssl.ServerName
+	}
+
+	return cfg, nil
+}
+
+func verifyPeer(roots *x509.CertPool, name string) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("upstream sent no certificate")
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			DNSName:       name,
+			Intermediates: intermediates,
+		})
+
+		return err
+	}
+}
+
+// SetUpstreamCheckTLS gives the groups proxied to over https the TLS
+// settings of the first location doing so, for their health checks
+func SetUpstreamCheckTLS(servers []config.Server) {
+	for _, server := range servers {
+		for _, location := range server.Locations {
+			for _, pass := range []*config.ProxyTarget{location.ProxyTarget, location.MirrorTarget} {
+				if pass == nil || pass.Scheme != "https" {
+					continue
+				}
+
+				target := resolveProxyTarget(pass)
+				if target.group == nil || target.group.CheckTLS() != nil {
+					continue
+				}
+
+				tls_cfg, err := upstreamTLSConfig(location.ProxySSL, proxyServerName(target))
+				if err != nil {
+					panic(fmt.Sprintf("upstream %s: %s", target.group.Name, err))
+				}
+
+				target.group.SetCheckTLS(tls_cfg)
+			}
+		}
+	}
+}
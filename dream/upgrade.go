@@ -0,0 +1,146 @@
+package dream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"dreamproxy/upstream"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"time"
+)
+
+// proxyUpgrade forwards a protocol upgrade handshake, e.g. WebSocket, on a
+// dedicated upstream connection. When the upstream switches protocols the
+// connection is kept in session.Tunnel, for HandleConnection to splice
+// with the client once the 101 is written.
+func (session *ClientSession) proxyUpgrade(req *http.HttpReq, location config.Location, target_uri string, target proxyTarget, req_log *logger.RequestLog) *http.HttpRes {
+	var res *http.HttpRes
+	var conn net.Conn
+
+	transport, err := session.proxyTransport(location, target)
+
+	if err != nil {
+		logUpstreamFailure(req, req_log, nil, err, false)
+		return http.NewErrorRes(http.StatusBadGateway)
+	}
+
+	upstream_req := *req
+	upstream_req.Headers = maps.Clone(req.Headers)
+
+	http.RemoveHopByHopHeaders(upstream_req.Headers)
+	upstream_req.SetForwardedHeaders(session.RemoteAddress, session.ClientIP, req.Headers["host"], location.AddForwarded)
+
+	vars := session.requestVariables(req, req_log.Request.ID)
+	vars["proxy_host"] = target.authority
+
+	setProxyHeaders(upstream_req.Headers, location, vars)
+	http.UpgradeHeaders(upstream_req.Headers, req.Headers["upgrade"])
+
+	tried := []*upstream.Server{}
+	origin_host, origin_port := target.host, target.port
+
+	for {
+		var server *upstream.Server
+
+		if target.group != nil {
+			next, next_err := target.group.Next(tried...)
+
+			if next_err != nil {
+				if err == nil {
+					err = next_err
+				}
+				break
+			}
+
+			server = next
+			tried = append(tried, server)
+			origin_host, origin_port = server.Host, server.Port
+			transport.Conns = server.Conns
+		}
+
+		upstream_start := time.Now()
+
+		res, conn, err = http.Upgrade(upstream_req, origin_host, origin_port, transport)
+
+		req_log.Trace.UpstreamIP = http.Address(origin_host, origin_port)
+		req_log.Trace.UpstreamLatencyMS = time.Since(upstream_start).Milliseconds()
+
+		if server != nil {
+			reportUpstreamResult(server, res, err)
+		}
+
+		// The handshake never reached a server that could not be dialed
+		var connect_err *http.ConnectError
+		if target.group == nil || !errors.As(err, &connect_err) {
+			break
+		}
+
+		logUpstreamFailure(req, req_log, res, err, true)
+	}
+
+	if err != nil {
+		logUpstreamFailure(req, req_log, res, err, false)
+
+		if http.IsTimeout(err) {
+			return http.NewErrorRes(http.StatusGatewayTimeout)
+		}
+		return http.NewErrorRes(http.StatusBadGateway)
+	}
+
+	upgrade := res.Headers["upgrade"]
+
+	res.SetReverseProxyHeaders()
+	hideProxyHeaders(res.Headers, location)
+
+	if conn == nil {
+		// Refused, answered like any other request
+		rewriteRedirects(res.Headers, location, proxyOrigins(target, origin_host, origin_port), proxyRedirectBase(location, target), vars)
+		return res
+	}
+
+	http.UpgradeHeaders(res.Headers, upgrade)
+
+	// Anything the upstream sent right after its 101 is part of the new protocol
+	delete(res.Headers, "content-length")
+
+	session.Tunnel = conn
+	session.TunnelIdleTimeout = transport.Timeouts.Read
+
+	return res
+}
+
+// spliceTunnel relays the upgraded connection until either side closes
+// or it stays idle, then logs its outcome
+func (session *ClientSession) spliceTunnel(req *http.HttpReq, req_log *logger.RequestLog) {
+	start := time.Now()
+
+	sent, received, err := http.Splice(session.Connection, session.Tunnel, session.TunnelIdleTimeout)
+
+	session.Tunnel = nil
+
+	msg := fmt.Sprintf("tunnel closed, %dB sent upstream", sent)
+	level := logger.INFO
+
+	if err != nil {
+		msg += ": " + err.Error()
+		if !http.IsTimeout(err) {
+			level = logger.WARN
+		}
+	}
+
+	log := logger.NewRequestLog(logger.DREAM_SERVER, level, logger.TUNNEL_CLOSED, msg)
+	log.Request.ID = req_log.Request.ID
+	log.Request.Method = req.Method
+	log.Request.Path = req.Target
+	log.Request.Host = req.Headers["host"]
+	log.Request.ClientIP = session.ClientIP
+	log.Response.StatusCode = req_log.Response.StatusCode
+	log.Response.BytesSent = received
+	log.Response.LatencyMS = time.Since(start).Milliseconds()
+	log.Trace = req_log.Trace
+
+	fmt.Println(log.ToText())
+}
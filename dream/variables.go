@@ -0,0 +1,97 @@
+package dream
+
+import (
+	"dreamproxy/http"
+	"net"
+	"strings"
+)
+
+// requestVariables exposes the request to directive values as $name.
+// Request headers are available as $http_<name>, dashes turned to underscores.
+func (session *ClientSession) requestVariables(req *http.HttpReq, request_id string) map[string]string {
+	host := req.Headers["host"]
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	uri, args, _ := strings.Cut(req.Target, "?")
+
+	server_port := ""
+	if _, port, err := net.SplitHostPort(session.Connection.LocalAddr().String()); err == nil {
+		server_port = port
+	}
+
+	vars := map[string]string{
+		"host":           host,
+		"remote_addr":    session.ClientIP,
+		"remote_port":    session.RemotePort,
+		"request_id":     request_id,
+		"scheme":         req.Scheme,
+		"request_method": req.Method,
+		"request_uri":    req.Target,
+		"uri":            uri,
+		"args":           args,
+		"server_port":    server_port,
+	}
+
+	for name, value := range req.Headers {
+		vars["http_"+strings.ReplaceAll(name, "-", "_")] = value
+	}
+
+	return vars
+}
+
+// interpolate replaces $name, ${name} and regex captures ($1) with their
+// value in vars, unknown variables expand to nothing
+func interpolate(value string, vars map[string]string) string {
+	if !strings.Contains(value, "$") {
+		return value
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < len(value); i++ {
+		if value[i] != '$' {
+			sb.WriteByte(value[i])
+			continue
+		}
+
+		name := ""
+		rest := value[i+1:]
+
+		if strings.HasPrefix(rest, "{") {
+			end := strings.IndexByte(rest, '}')
+			if end == -1 {
+				sb.WriteString(value[i:])
+				break
+			}
+			name = rest[1:end]
+			i += end + 1
+		} else {
+			end := 0
+			for end < len(rest) && isVariableChar(rest[end]) {
+				end++
+
+				// Captures are a single digit, "$1st" is $1 then "st"
+				if '0' <= rest[0] && rest[0] <= '9' {
+					break
+				}
+			}
+			name = rest[:end]
+			i += end
+		}
+
+		if name == "" {
+			sb.WriteByte('$')
+			continue
+		}
+
+		sb.WriteString(vars[name])
+	}
+
+	return sb.String()
+}
+
+func isVariableChar(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || ('0' <= ch && ch <= '9')
+}
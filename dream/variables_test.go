@@ -0,0 +1,30 @@
+package dream
+
+import "testing"
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{"host": "example.com", "uri": "/a", "1": "one"}
+
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"no variables", "no variables"},
+		{"$host", "example.com"},
+		{"https://$host$uri", "https://example.com/a"},
+		{"${host}name", "example.comname"},
+		{"$hostname", ""},
+		{"$unknown/x", "/x"},
+		{"${unknown}x", "x"},
+		{"$1st", "onest"},
+		{"cost: 5$", "cost: 5$"},
+		{"$-", "$-"},
+		{"${host", "${host"},
+	}
+
+	for _, tt := range tests {
+		if got := interpolate(tt.value, vars); got != tt.want {
+			t.Errorf("interpolate(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package fastcgi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// FastCGI client, see https://fastcgi-archives.github.io/FastCGI_Specification.html
+
+const (
+	VERSION_1 = 1
+
+	TYPE_BEGIN_REQUEST = 1
+	TYPE_ABORT_REQUEST = 2
+	TYPE_END_REQUEST   = 3
+	TYPE_PARAMS        = 4
+	TYPE_STDIN         = 5
+	TYPE_STDOUT        = 6
+	TYPE_STDERR        = 7
+
+	ROLE_RESPONDER = 1
+
+	// protocolStatus of END_REQUEST
+	REQUEST_COMPLETE = 0
+	CANT_MPX_CONN    = 1
+	OVERLOADED       = 2
+	UNKNOWN_ROLE     = 3
+
+	HEADER_LENGTH      = 8
+	MAX_CONTENT_LENGTH = 65535
+
+	// A single request per connection, it is closed afterwards
+	REQUEST_ID = 1
+)
+
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Response is what the application sent back, Stdout holding a CGI response
+type Response struct {
+	Stdout    []byte
+	Stderr    []byte
+	AppStatus uint32
+}
+
+// Do runs a responder request over conn, used for this request only
+func Do(conn io.ReadWriter, params []Param, stdin []byte) (*Response, error) {
+	var buf bytes.Buffer
+
+	// Role then flags, keepConn unset: the application closes the connection
+	begin := []byte{0, ROLE_RESPONDER, 0, 0, 0, 0, 0, 0}
+	writeRecord(&buf, TYPE_BEGIN_REQUEST, begin)
+	writeStream(&buf, TYPE_PARAMS, EncodeParams(params))
+	writeStream(&buf, TYPE_STDIN, stdin)
+
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return readResponse(conn)
+}
+
+// EncodeParams encodes name-value pairs, lengths over 127 take 4 bytes
+// with the high bit set
+func EncodeParams(params []Param) []byte {
+	var buf bytes.Buffer
+
+	for _, param := range params {
+		writeLength(&buf, len(param.Name))
+		writeLength(&buf, len(param.Value))
+		buf.WriteString(param.Name)
+		buf.WriteString(param.Value)
+	}
+
+	return buf.Bytes()
+}
+
+func writeLength(buf *bytes.Buffer, length int) {
+	if length < 128 {
+		buf.WriteByte(byte(length))
+		return
+	}
+	binary.Write(buf, binary.BigEndian, uint32(length)|1<<31)
+}
+
+// writeStream splits content in records, ended with an empty one
+func writeStream(buf *bytes.Buffer, record_type byte, content []byte) {
+	for len(content) > 0 {
+		n := min(len(content), MAX_CONTENT_LENGTH)
+		writeRecord(buf, record_type, content[:n])
+		content = content[n:]
+	}
+	writeRecord(buf, record_type, nil)
+}
+
+func writeRecord(buf *bytes.Buffer, record_type byte, content []byte) {
+	// Records are padded to a multiple of 8 bytes
+	padding := -len(content) & 7
+
+	buf.Write([]byte{VERSION_1, record_type, 0, REQUEST_ID})
+	binary.Write(buf, binary.BigEndian, uint16(len(content)))
+	buf.Write([]byte{byte(padding), 0})
+	buf.Write(content)
+	buf.Write(make([]byte, padding))
+}
+
+func readResponse(conn io.Reader) (*Response, error) {
+	res := &Response{}
+	header := make([]byte, HEADER_LENGTH)
+
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return nil, fmt.Errorf("fastcgi: reading record: %w", err)
+		}
+
+		if header[0] != VERSION_1 {
+			return nil, fmt.Errorf("fastcgi: unsupported version %d", header[0])
+		}
+
+		record_type := header[1]
+		request_id := binary.BigEndian.Uint16(header[2:4])
+		content_length := binary.BigEndian.Uint16(header[4:6])
+		padding_length := header[6]
+
+		content := make([]byte, int(content_length)+int(padding_length))
+		if _, err := io.ReadFull(conn, content); err != nil {
+			return nil, fmt.Errorf("fastcgi: reading record: %w", err)
+		}
+		content = content[:content_length]
+
+		// Management records have id 0
+		if request_id != REQUEST_ID {
+			continue
+		}
+
+		switch record_type {
+		case TYPE_STDOUT:
+			res.Stdout = append(res.Stdout, content...)
+		case TYPE_STDERR:
+			res.Stderr = append(res.Stderr, content...)
+		case TYPE_END_REQUEST:
+			if len(content) < 8 {
+				return nil, fmt.Errorf("fastcgi: short END_REQUEST record")
+			}
+
+			res.AppStatus = binary.BigEndian.Uint32(content[:4])
+
+			if status := content[4]; status != REQUEST_COMPLETE {
+				return nil, fmt.Errorf("fastcgi: request rejected, protocol status %d", status)
+			}
+
+			return res, nil
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package fastcgi
+
+import (
+	"bytes"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/fcgi"
+	"strings"
+	"testing"
+)
+
+func TestDo(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go fcgi.Serve(listener, nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		body, _ := io.ReadAll(r.Body)
+		env := fcgi.ProcessEnv(r)
+
+		w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+		w.Header().Set("X-Long", r.Header.Get("X-Long"))
+		w.WriteHeader(nethttp.StatusCreated)
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + string(body)))
+	}))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Over 127 bytes, the length takes 4 bytes
+	long := strings.Repeat("x", 300)
+	// Over a record, stdin is split
+	body := bytes.Repeat([]byte("b"), MAX_CONTENT_LENGTH+10)
+
+	res, err := Do(conn, []Param{
+		{Name: "REQUEST_METHOD", Value: "POST"},
+		{Name: "REQUEST_URI", Value: "/index.php?a=1"},
+		{Name: "SERVER_PROTOCOL", Value: "HTTP/1.1"},
+		{Name: "CONTENT_LENGTH", Value: "65545"},
+		{Name: "SCRIPT_FILENAME", Value: "/srv/index.php"},
+		{Name: "HTTP_X_LONG", Value: long},
+	}, body)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := string(res.Stdout)
+
+	for _, want := range []string{"Status: 201", "X-Script: /srv/index.php", "X-Long: " + long, "POST /index.php?a=1 " + string(body)} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("stdout misses %.40q", want)
+		}
+	}
+}
+
+func TestEncodeParams(t *testing.T) {
+	got := EncodeParams([]Param{{Name: "A", Value: strings.Repeat("v", 200)}})
+
+	want := append([]byte{1, 0x80, 0, 0, 200, 'A'}, strings.Repeat("v", 200)...)
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x", got[:8])
+	}
+}
@@ -2,4 +2,4 @@ module dreamproxy
 
 go 1.24.5
 
-require github.com/google/uuid v1.6.0 // indirect
+require github.com/google/uuid v1.6.0
@@ -35,3 +35,16 @@ func NewBadRequestRes(req HttpReq, remoteAddr string, err error) *HttpRes {
 	fmt.Println(log.ToText())
 	return res
 }
+
+// NewErrorRes builds a bare HTML response for errors generated by the proxy itself
+func NewErrorRes(status StatusCode) *HttpRes {
+	res := CreateHttpRes()
+	res.Status = status
+
+	body := fmt.Sprintf("<h1>%d %s</h1>", status, status.ToStr())
+	res.Headers["content-type"] = "text/html; charset=utf-8"
+	res.Headers["content-length"] = fmt.Sprint(len(body))
+	res.Body = []byte(body)
+
+	return res
+}
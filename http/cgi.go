@@ -0,0 +1,117 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseCGIResponse turns the output of a CGI script or FastCGI application
+// into a response (RFC 3875, 6)
+func ParseCGIResponse(raw []byte) (*HttpRes, error) {
+	headers, body, err := parseHeaderBlock(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("cgi: response without headers")
+	}
+
+	status := StatusOK
+
+	if raw_status, ok := headers["status"]; ok {
+		code, _, _ := strings.Cut(raw_status, " ")
+		parsed, err := parseStatusCode(code)
+
+		if err != nil {
+			return nil, fmt.Errorf("cgi: invalid Status header %q", raw_status)
+		}
+
+		status = parsed
+		delete(headers, "status")
+	} else if headers["location"] != "" {
+		status = StatusFound
+	}
+
+	return newGatewayRes(status, headers, body), nil
+}
+
+// ParseGatewayResponse parses SCGI and uwsgi responses, which start with a
+// status line or a Status header
+func ParseGatewayResponse(raw []byte) (*HttpRes, error) {
+	if !bytes.HasPrefix(raw, []byte("HTTP/")) {
+		return ParseCGIResponse(raw)
+	}
+
+	status_line, rest, _ := bytes.Cut(raw, []byte("\n"))
+	parts := strings.Fields(string(status_line))
+
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid status line")
+	}
+
+	status, err := parseStatusCode(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid status code: %s", parts[1])
+	}
+
+	headers, body, err := parseHeaderBlock(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGatewayRes(status, headers, body), nil
+}
+
+func newGatewayRes(status StatusCode, headers map[string]string, body []byte) *HttpRes {
+	// Sent with its length, or the one the application gave without a body (HEAD)
+	delete(headers, "transfer-encoding")
+	if len(body) > 0 || headers["content-length"] == "" {
+		headers["content-length"] = fmt.Sprint(len(body))
+	}
+
+	return &HttpRes{
+		Version: V1_1,
+		Status:  status,
+		Headers: headers,
+		Body:    body,
+	}
+}
+
+func parseStatusCode(code string) (StatusCode, error) {
+	parsed, err := strconv.Atoi(code)
+	if err != nil || parsed < 100 || parsed > 999 {
+		return 0, fmt.Errorf("invalid status code: %s", code)
+	}
+
+	return StatusCode(parsed), nil
+}
+
+// parseHeaderBlock splits at the first empty line, scripts may end their
+// lines with LF only
+func parseHeaderBlock(raw []byte) (map[string]string, []byte, error) {
+	var raw_headers string
+	var body []byte
+
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+
+	switch {
+	case bytes.HasPrefix(raw, []byte("\r\n")):
+		body = raw[2:]
+	case bytes.HasPrefix(raw, []byte("\n")):
+		body = raw[1:]
+	case crlf != -1 && (lf == -1 || crlf < lf):
+		raw_headers, body = string(raw[:crlf]), raw[crlf+4:]
+	case lf != -1:
+		raw_headers, body = string(raw[:lf]), raw[lf+2:]
+	default:
+		return nil, nil, fmt.Errorf("no end of headers in response")
+	}
+
+	raw_headers = strings.ReplaceAll(strings.ReplaceAll(raw_headers, "\r\n", "\n"), "\n", "\r\n")
+
+	return ParseHttpHeaders(raw_headers), body, nil
+}
@@ -0,0 +1,92 @@
+package http
+
+import "testing"
+
+func TestParseCGIResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		wantErr  bool
+		status   StatusCode
+		location string
+		body     string
+		length   string
+	}{
+		{
+			name:   "Document response",
+			raw:    "Content-Type: text/plain\r\n\r\nhello",
+			status: StatusOK,
+			body:   "hello",
+		},
+		{
+			name:   "Status header, LF line endings",
+			raw:    "Status: 404 Not Found\nContent-Type: text/plain\n\nmissing",
+			status: StatusNotFound,
+			body:   "missing",
+		},
+		{
+			name:     "Location without Status",
+			raw:      "Location: https://example.com/\r\n\r\n",
+			status:   StatusFound,
+			location: "https://example.com/",
+		},
+		{
+			name:     "Location with Status",
+			raw:      "Status: 301\r\nLocation: /moved\r\n\r\n",
+			status:   StatusMovedPermanently,
+			location: "/moved",
+		},
+		{
+			name:   "Length of the application kept without a body",
+			raw:    "Content-Type: text/plain\r\nContent-Length: 42\r\n\r\n",
+			status: StatusOK,
+			length: "42",
+		},
+		{
+			name:   "Length of the body",
+			raw:    "Content-Length: 42\r\n\r\nhello",
+			status: StatusOK,
+			body:   "hello",
+			length: "5",
+		},
+		{
+			name:    "Invalid Status",
+			raw:     "Status: abc\r\n\r\n",
+			wantErr: true,
+		},
+		{
+			name:    "No end of headers",
+			raw:     "Content-Type: text/plain\r\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ParseCGIResponse([]byte(tt.raw))
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", res)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Status != tt.status || res.Headers["location"] != tt.location || string(res.Body) != tt.body {
+				t.Errorf("got %d %q %q", res.Status, res.Headers["location"], res.Body)
+			}
+
+			if tt.length != "" && res.Headers["content-length"] != tt.length {
+				t.Errorf("content-length = %q, want %s", res.Headers["content-length"], tt.length)
+			}
+
+			if _, ok := res.Headers["status"]; ok {
+				t.Errorf("Status header passed on")
+			}
+		})
+	}
+}
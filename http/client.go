@@ -1,15 +1,97 @@
 package http
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type RequestConfig struct {
 	Query   map[string]string
 	Headers map[string]string
 	Body    []byte
+
+	Transport Transport
+}
+
+// Transport describes how a request reaches the upstream, as opposed to
+// what is sent
+type Transport struct {
+	Timeouts Timeouts
+
+	// PROXY protocol header written before the request, on a connection
+	// dedicated to it
+	ProxyProtocol []byte
+
+	// Speaks TLS to the upstream when set
+	TLS *tls.Config
+
+	// Pool settings and connection count of the upstream server, nil for
+	// hosts outside of upstream groups
+	Conns *ServerConns
+}
+
+// Timeouts toward an upstream, zero means no timeout.
+// Send and Read bound the wait between two successive writes or reads,
+// not the whole transfer.
+type Timeouts struct {
+	Connect time.Duration
+	Send    time.Duration
+	Read    time.Duration
+}
+
+// timeoutConn refreshes its deadlines before every read and write
+type timeoutConn struct {
+	net.Conn
+	timeouts Timeouts
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.timeouts.Read > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeouts.Read))
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.timeouts.Send > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeouts.Send))
+	}
+	return c.Conn.Write(b)
+}
+
+// countingConn counts the bytes read, to tell whether a response started
+type countingConn struct {
+	net.Conn
+	read int
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read += n
+	return n, err
+}
+
+// closedBeforeResponse tells whether a request failed because the upstream
+// closed or reset the connection before sending anything back. Timeouts
+// are not, the upstream may still be working on the request.
+func closedBeforeResponse(err error, read int) bool {
+	if read > 0 || IsTimeout(err) {
+		return false
+	}
+
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// NewTimeoutConn applies the send and read timeouts to conn, for clients of
+// other upstream protocols
+func NewTimeoutConn(conn net.Conn, timeouts Timeouts) net.Conn {
+	return &timeoutConn{Conn: conn, timeouts: timeouts}
 }
 
 func PreprocessCfg(cfg RequestConfig, host string, path string) RequestConfig {
@@ -19,6 +101,11 @@ func PreprocessCfg(cfg RequestConfig, host string, path string) RequestConfig {
 
 	if cfg.Headers["host"] == "" {
 		cfg.Headers["host"] = host
+
+		// A socket path means nothing to the upstream
+		if IsUnixAddress(host) {
+			cfg.Headers["host"] = "localhost"
+		}
 	}
 
 	if strings.HasSuffix(path, "/") {
@@ -48,13 +135,136 @@ func PreprocessCfg(cfg RequestConfig, host string, path string) RequestConfig {
 	return cfg
 }
 
-func HandleRequest(req HttpReq, host string, port int) (*HttpRes, error) {
-	connection, err := net.Dial("tcp4", net.JoinHostPort(host, fmt.Sprint(port)))
+// ConnectError reports a failure to reach the upstream, nothing of the
+// request has been sent when it is returned
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+func IsTimeout(err error) bool {
+	var net_err net.Error
+	return errors.As(err, &net_err) && net_err.Timeout()
+}
+
+// Prefix of upstream addresses naming a Unix domain socket, e.g. "unix:/run/app.sock"
+const UNIX_PREFIX = "unix:"
+
+func IsUnixAddress(host string) bool {
+	return strings.HasPrefix(host, UNIX_PREFIX)
+}
+
+// Address is the pool key and dial address of an upstream. Unix socket
+// hosts carry their path and ignore the port.
+func Address(host string, port int) string {
+	if IsUnixAddress(host) {
+		return host
+	}
+	return net.JoinHostPort(host, fmt.Sprint(port))
+}
+
+// Dial connects to an address built by Address
+func Dial(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+
+	if IsUnixAddress(address) {
+		return dialer.Dial("unix", strings.TrimPrefix(address, UNIX_PREFIX))
+	}
+
+	return dialer.Dial("tcp", address)
+}
+
+// dialUpstream connects to address, then writes the PROXY protocol header
+// and performs the TLS handshake when needed, all within timeout
+func dialUpstream(address string, timeout time.Duration, proxy_protocol []byte, tls_cfg *tls.Config) (net.Conn, error) {
+	conn, err := Dial(address, timeout)
+
+	if err != nil || (proxy_protocol == nil && tls_cfg == nil) {
+		return conn, err
+	}
+
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	if proxy_protocol != nil {
+		if _, err := conn.Write(proxy_protocol); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if tls_cfg != nil {
+		tls_conn := tls.Client(conn, tls_cfg)
+
+		if err := tls_conn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		conn = tls_conn
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// HandleRequest sends req to host:port over a pooled keep-alive connection
+func HandleRequest(req HttpReq, host string, port int, transport Transport) (*HttpRes, error) {
+	address := Address(host, port)
+	timeouts := transport.Timeouts
+
+	// The PROXY protocol header ties the connection to one client,
+	// so it is dialed for this request only and never pooled
+	if transport.ProxyProtocol != nil {
+		connection, err := dialCounted(address, timeouts.Connect, transport.ProxyProtocol, transport.TLS, transport.Conns)
+
+		if err != nil {
+			return nil, &ConnectError{Err: err}
+		}
+
+		defer connection.Close()
+
+		return roundTrip(&timeoutConn{Conn: connection, timeouts: timeouts}, req)
+	}
+
+	for {
+		connection, reused, err := DefaultPool.Get(address, timeouts.Connect, transport.TLS, transport.Conns)
+
+		if err != nil {
+			return nil, &ConnectError{Err: err}
+		}
+
+		counted := &countingConn{Conn: &timeoutConn{Conn: connection, timeouts: timeouts}}
+		res, err := roundTrip(counted, req)
+
+		if err != nil {
+			DefaultPool.Put(address, transport.TLS, transport.Conns, connection, false)
+
+			// The upstream may have closed an idle connection just as we picked it,
+			// try again on another one, at worst a fresh dial
+			if reused && IsIdempotent(req.Method) && closedBeforeResponse(err, counted.read) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		DefaultPool.Put(address, transport.TLS, transport.Conns, connection, isReusable(req, res))
 
-	if err != nil {
-		return nil, err
+		return res, nil
 	}
+}
 
+func roundTrip(connection net.Conn, req HttpReq) (*HttpRes, error) {
 	req_bytes := req.ToBytes()
 	req_len := len(req_bytes)
 	written_bytes := 0
@@ -73,19 +283,26 @@ func HandleRequest(req HttpReq, host string, port int) (*HttpRes, error) {
 		written_bytes += n
 	}
 
-	res_str, err := ReadFullHttpMessage(connection)
+	for {
+		res_str, err := ReadHttpResponse(connection, req.Method)
 
-	if err != nil {
-		return nil, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	res, err := ParseRawHttpRes(res_str)
+		res, err := ParseRawHttpRes(res_str)
 
-	if err != nil {
-		return nil, err
-	}
+		if err != nil {
+			return nil, err
+		}
 
-	return res, nil
+		// Interim responses (100 Continue) precede the final one
+		if res.Status < 200 && res.Status != StatusSwitchingProtocols {
+			continue
+		}
+
+		return res, nil
+	}
 }
 
 func MakeRequest(method string, host string, port int, path string, cfg RequestConfig) (*HttpRes, error) {
@@ -100,7 +317,7 @@ func MakeRequest(method string, host string, port int, path string, cfg RequestC
 		Body:    cfg.Body,
 	}
 
-	return HandleRequest(req, host, port)
+	return HandleRequest(req, host, port, cfg.Transport)
 }
 
 func Get(host string, port int, path string, cfg RequestConfig) (*HttpRes, error) {
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startFullBacklog listens without ever accepting, with a connection
+// already filling the backlog so that Linux drops further SYNs
+func startFullBacklog(t *testing.T) int {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := sa.(*syscall.SockaddrInet4).Port
+
+	conn, err := Dial(Address("127.0.0.1", port), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return port
+}
+
+func TestConnectTimeout(t *testing.T) {
+	port := startFullBacklog(t)
+	cfg := RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: 200 * time.Millisecond, Send: time.Second, Read: time.Second}}}
+
+	start := time.Now()
+	_, err := Get("127.0.0.1", port, "/", cfg)
+	elapsed := time.Since(start)
+
+	var connect_err *ConnectError
+	if !errors.As(err, &connect_err) {
+		t.Fatalf("expected a connect error, got %v", err)
+	}
+	if !IsTimeout(err) {
+		t.Errorf("connect error not classified as a timeout: %v", err)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("timed out after %s", elapsed)
+	}
+}
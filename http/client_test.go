@@ -0,0 +1,58 @@
+package http
+
+import (
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBodylessResponses(t *testing.T) {
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		switch r.URL.Path {
+		case "/not-modified":
+			// Sent as if it were the full response
+			w.Header().Set("Content-Length", "5")
+			w.WriteHeader(nethttp.StatusNotModified)
+		default:
+			w.Header().Set("Content-Length", "5")
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	cfg := RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: 2 * time.Second}}}
+
+	tests := []struct {
+		method string
+		path   string
+		status StatusCode
+		body   string
+	}{
+		{"HEAD", "/", StatusOK, ""},
+		{"GET", "/not-modified", StatusNotModified, ""},
+		// On the connection reused from the bodyless responses
+		{"GET", "/", StatusOK, "hello"},
+	}
+
+	for _, tt := range tests {
+		start := time.Now()
+		res, err := MakeRequest(tt.method, addr.IP.String(), addr.Port, tt.path, cfg)
+
+		if err != nil {
+			t.Fatalf("%s %s: %v", tt.method, tt.path, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s %s took %s", tt.method, tt.path, elapsed)
+		}
+		if res.Status != tt.status || string(res.Body) != tt.body {
+			t.Errorf("%s %s = %d %q, want %d %q", tt.method, tt.path, res.Status, res.Body, tt.status, tt.body)
+		}
+		if tt.method == "HEAD" && res.Headers["content-length"] != strconv.Itoa(len("hello")) {
+			t.Errorf("HEAD content-length = %q", res.Headers["content-length"])
+		}
+	}
+}
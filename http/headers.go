@@ -0,0 +1,84 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Headers meaningful only for a single connection (RFC 7230 section 6.1),
+// they must not be forwarded by proxies
+var HOP_BY_HOP_HEADERS = []string{
+	"connection",
+	"keep-alive",
+	"proxy-authenticate",
+	"proxy-authorization",
+	"proxy-connection",
+	"te",
+	"trailer",
+	"transfer-encoding",
+	"upgrade",
+}
+
+// RemoveHopByHopHeaders deletes the standard hop-by-hop headers, any
+// Proxy-* header and the headers the sender listed in Connection
+func RemoveHopByHopHeaders(headers map[string]string) {
+	for _, name := range strings.Split(headers["connection"], ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			delete(headers, name)
+		}
+	}
+
+	for _, name := range HOP_BY_HOP_HEADERS {
+		delete(headers, name)
+	}
+
+	for name := range headers {
+		if strings.HasPrefix(name, "proxy-") {
+			delete(headers, name)
+		}
+	}
+}
+
+// SetForwardedHeaders records the client and the original request for the
+// upstream. The chains left by previous proxies are extended with peer_ip,
+// the address the request came from, while X-Real-IP carries client_ip,
+// the resolved address of the client.
+func (req *HttpReq) SetForwardedHeaders(peer_ip string, client_ip string, host string, add_forwarded bool) {
+	if xff := req.Headers["x-forwarded-for"]; xff != "" {
+		req.Headers["x-forwarded-for"] = xff + ", " + peer_ip
+	} else {
+		req.Headers["x-forwarded-for"] = peer_ip
+	}
+
+	req.Headers["x-forwarded-proto"] = req.Scheme
+	req.Headers["x-forwarded-host"] = host
+	req.Headers["x-real-ip"] = client_ip
+
+	if !add_forwarded {
+		return
+	}
+
+	// RFC 7239 wants IPv6 addresses bracketed and quoted
+	node := peer_ip
+	if strings.Contains(peer_ip, ":") {
+		node = fmt.Sprintf("\"[%s]\"", peer_ip)
+	}
+
+	element := fmt.Sprintf("for=%s;host=%s;proto=%s", node, quoteForwarded(host), req.Scheme)
+
+	if forwarded := req.Headers["forwarded"]; forwarded != "" {
+		req.Headers["forwarded"] = forwarded + ", " + element
+	} else {
+		req.Headers["forwarded"] = element
+	}
+}
+
+// quoteForwarded quotes values that are not valid RFC 7230 tokens, like host:port
+func quoteForwarded(value string) string {
+	if _, _, err := net.SplitHostPort(value); err == nil || strings.ContainsAny(value, "[]\"") {
+		return fmt.Sprintf("%q", value)
+	}
+	return value
+}
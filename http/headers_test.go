@@ -0,0 +1,111 @@
+package http
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestRemoveHopByHopHeaders(t *testing.T) {
+	headers := map[string]string{
+		"connection":          "keep-alive, X-Internal , Upgrade",
+		"keep-alive":          "timeout=5",
+		"upgrade":             "websocket",
+		"x-internal":          "secret",
+		"te":                  "trailers",
+		"transfer-encoding":   "chunked",
+		"proxy-authorization": "Basic YW5hOnMzY3JldA==",
+		"proxy-foo":           "bar",
+		"host":                "example.com",
+		"x-kept":              "yes",
+	}
+
+	RemoveHopByHopHeaders(headers)
+
+	want := map[string]string{"host": "example.com", "x-kept": "yes"}
+	if !maps.Equal(headers, want) {
+		t.Errorf("got %v, want %v", headers, want)
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name          string
+		headers       map[string]string
+		peer_ip       string
+		client_ip     string
+		host          string
+		add_forwarded bool
+		want          map[string]string
+	}{
+		{
+			name:      "First proxy",
+			headers:   map[string]string{},
+			peer_ip:   "192.0.2.1",
+			client_ip: "192.0.2.1",
+			host:      "example.com",
+			want: map[string]string{
+				"x-forwarded-for":   "192.0.2.1",
+				"x-forwarded-proto": "http",
+				"x-forwarded-host":  "example.com",
+				"x-real-ip":         "192.0.2.1",
+			},
+		},
+		{
+			name:      "Existing chain is extended with the peer",
+			headers:   map[string]string{"x-forwarded-for": "203.0.113.7, 198.51.100.2"},
+			peer_ip:   "192.0.2.1",
+			client_ip: "203.0.113.7",
+			host:      "example.com",
+			want: map[string]string{
+				"x-forwarded-for":   "203.0.113.7, 198.51.100.2, 192.0.2.1",
+				"x-forwarded-proto": "http",
+				"x-forwarded-host":  "example.com",
+				"x-real-ip":         "203.0.113.7",
+			},
+		},
+		{
+			name:          "Forwarded with a bare host",
+			headers:       map[string]string{},
+			peer_ip:       "192.0.2.1",
+			client_ip:     "192.0.2.1",
+			host:          "example.com",
+			add_forwarded: true,
+			want:          map[string]string{"forwarded": "for=192.0.2.1;host=example.com;proto=http"},
+		},
+		{
+			name:          "Forwarded quotes IPv6 and host:port",
+			headers:       map[string]string{"forwarded": "for=203.0.113.7"},
+			peer_ip:       "2001:db8::1",
+			client_ip:     "2001:db8::1",
+			host:          "example.com:8080",
+			add_forwarded: true,
+			want:          map[string]string{"forwarded": `for=203.0.113.7, for="[2001:db8::1]";host="example.com:8080";proto=http`},
+		},
+		{
+			name:          "Forwarded quotes a bracketed IPv6 host",
+			headers:       map[string]string{},
+			peer_ip:       "192.0.2.1",
+			client_ip:     "192.0.2.1",
+			host:          "[2001:db8::2]",
+			add_forwarded: true,
+			want:          map[string]string{"forwarded": `for=192.0.2.1;host="[2001:db8::2]";proto=http`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := HttpReq{Scheme: "http", Headers: tt.headers}
+			req.SetForwardedHeaders(tt.peer_ip, tt.client_ip, tt.host, tt.add_forwarded)
+
+			for name, want := range tt.want {
+				if got := req.Headers[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+
+			if _, ok := req.Headers["forwarded"]; ok && !tt.add_forwarded {
+				t.Errorf("unexpected forwarded %q", req.Headers["forwarded"])
+			}
+		})
+	}
+}
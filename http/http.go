@@ -1,6 +1,7 @@
 package http
 
 import (
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +27,39 @@ var HTTP_METHODS = []string{
 	"POST",
 	"PATCH",
 	"CONNECT",
+	"PURGE", // Drops cached responses, see proxy_cache_purge
+}
+
+// Methods that can safely be replayed against another upstream
+var IDEMPOTENT_METHODS = []string{
+	"GET",
+	"HEAD",
+	"OPTIONS",
+	"TRACE",
+	"DELETE",
+	"PUT",
+}
+
+func IsIdempotent(method string) bool {
+	return slices.Contains(IDEMPOTENT_METHODS, strings.ToUpper(method))
+}
+
+// Responses whose Location the client is expected to follow
+var REDIRECT_STATUSES = []StatusCode{
+	StatusMovedPermanently,
+	StatusFound,
+	StatusSeeOther,
+	StatusTemporaryRedirect,
+	StatusPermanentRedirect,
+}
+
+func IsRedirect(status StatusCode) bool {
+	return slices.Contains(REDIRECT_STATUSES, status)
+}
+
+// IsBodyless tells whether the response to method with status has no body
+func IsBodyless(method string, status StatusCode) bool {
+	return method == "HEAD" || status < 200 || status == StatusNoContent || status == StatusNotModified
 }
 
 type HttpReq struct {
@@ -87,6 +121,10 @@ type HttpRes struct {
 
 	// Response Body
 	Body []byte
+
+	// Headers removed by the configuration (remove_header), which
+	// SetServerHeaders does not add back
+	RemovedHeaders []string
 }
 
 func CreateHttpRes() *HttpRes {
@@ -96,15 +134,30 @@ func CreateHttpRes() *HttpRes {
 	}
 }
 
+// SetServerHeaders adds our identity, keeping the Server and Date an
+// upstream response was allowed to pass (see proxy_pass_header)
 func (res *HttpRes) SetServerHeaders() {
 	now := time.Now().UTC() // Make this configurable
-	res.Headers["server"] = "dreamserver/0.0.1 (Archlinux)"
-	res.Headers["Via"] = "HTTP/1.1 dreamserver"
-	res.Headers["date"] = now.Format(time.RFC1123)
+	if res.Headers["server"] == "" && !slices.Contains(res.RemovedHeaders, "server") {
+		res.Headers["server"] = "dreamserver/0.0.1 (Archlinux)"
+	}
+	if !slices.Contains(res.RemovedHeaders, "via") {
+		res.Headers["Via"] = "HTTP/1.1 dreamserver"
+	}
+	if res.Headers["date"] == "" && !slices.Contains(res.RemovedHeaders, "date") {
+		res.Headers["date"] = now.Format(time.RFC1123)
+	}
 }
 
+// SetReverseProxyHeaders strips the hop-by-hop headers of an upstream
+// response before it is relayed to the client
 func (res *HttpRes) SetReverseProxyHeaders() {
+	RemoveHopByHopHeaders(res.Headers)
 
+	// The body is fully buffered, so it can always be framed by its length
+	if res.Headers["content-length"] == "" && len(res.Body) > 0 {
+		res.Headers["content-length"] = strconv.Itoa(len(res.Body))
+	}
 }
 
 func (res *HttpRes) ToBytes() []byte {
@@ -159,42 +212,58 @@ func IsValidHTTPVersion(version string) bool {
 type StatusCode int
 
 const (
+	StatusSwitchingProtocols  StatusCode = 101
 	StatusOK                  StatusCode = 200
 	StatusCreated             StatusCode = 201
 	StatusAccepted            StatusCode = 202
 	StatusNoContent           StatusCode = 204
+	StatusPartialContent      StatusCode = 206
 	StatusMovedPermanently    StatusCode = 301
 	StatusFound               StatusCode = 302
+	StatusSeeOther            StatusCode = 303
+	StatusNotModified         StatusCode = 304
+	StatusTemporaryRedirect   StatusCode = 307
+	StatusPermanentRedirect   StatusCode = 308
 	StatusBadRequest          StatusCode = 400
 	StatusUnauthorized        StatusCode = 401
 	StatusForbidden           StatusCode = 403
 	StatusNotFound            StatusCode = 404
 	StatusMethodNotAllowed    StatusCode = 405
+	StatusProxyAuthRequired   StatusCode = 407
 	StatusConflict            StatusCode = 409
 	StatusInternalServerError StatusCode = 500
 	StatusNotImplemented      StatusCode = 501
 	StatusBadGateway          StatusCode = 502
 	StatusServiceUnavailable  StatusCode = 503
+	StatusGatewayTimeout      StatusCode = 504
 )
 
 // statusText maps HTTP status codes to their messages.
 var StatusText = map[StatusCode]string{
+	StatusSwitchingProtocols:  "Switching Protocols",
 	StatusOK:                  "OK",
 	StatusCreated:             "Created",
 	StatusAccepted:            "Accepted",
 	StatusNoContent:           "No Content",
+	StatusPartialContent:      "Partial Content",
 	StatusMovedPermanently:    "Moved Permanently",
 	StatusFound:               "Found",
+	StatusSeeOther:            "See Other",
+	StatusNotModified:         "Not Modified",
+	StatusTemporaryRedirect:   "Temporary Redirect",
+	StatusPermanentRedirect:   "Permanent Redirect",
 	StatusBadRequest:          "Bad Request",
 	StatusUnauthorized:        "Unauthorized",
 	StatusForbidden:           "Forbidden",
 	StatusNotFound:            "Not Found",
 	StatusMethodNotAllowed:    "Method Not Allowed",
+	StatusProxyAuthRequired:   "Proxy Authentication Required",
 	StatusConflict:            "Conflict",
 	StatusInternalServerError: "Internal Server Error",
 	StatusNotImplemented:      "Not Implemented",
 	StatusBadGateway:          "Bad Gateway",
 	StatusServiceUnavailable:  "Service Unavailable",
+	StatusGatewayTimeout:      "Gateway Timeout",
 }
 
 // Text returns the standard text for the HTTP status code.
@@ -214,6 +214,22 @@ func isValidTarget(target string, method string) bool {
 	}
 }
 
+// hasResponseBody tells from its status line whether a response has a
+// body, whatever its Content-Length says
+func hasResponseBody(method string, status_line []byte) bool {
+	fields := strings.Fields(string(status_line))
+	if len(fields) < 2 {
+		return true
+	}
+
+	status, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return true
+	}
+
+	return !IsBodyless(method, StatusCode(status))
+}
+
 func ExtractHeadersAndBodyStart(c net.Conn) ([]byte, []byte, error) {
 	var req_buf bytes.Buffer
 	var body_buf bytes.Buffer
@@ -278,6 +294,16 @@ func ExtractHeadersAndBodyStart(c net.Conn) ([]byte, []byte, error) {
 }
 
 func ReadFullHttpMessage(c net.Conn) (string, error) {
+	return readHttpMessage(c, "")
+}
+
+// ReadHttpResponse reads the response to a request made with method
+func ReadHttpResponse(c net.Conn, method string) (string, error) {
+	return readHttpMessage(c, method)
+}
+
+// readHttpMessage reads a request, or a response when method is set
+func readHttpMessage(c net.Conn, method string) (string, error) {
 	tmp_buf := make([]byte, 2048)
 
 	var req_buf bytes.Buffer
@@ -291,15 +317,19 @@ func ReadFullHttpMessage(c net.Conn) (string, error) {
 		return "", err
 	}
 
+	// Extract Headers
+	eo_reqline := bytes.Index(req_bytes, []byte("\r\n"))
+
+	if method != "" && !hasResponseBody(method, req_bytes[:eo_reqline]) {
+		return string(req_bytes), nil
+	}
+
 	body_buf.Grow(1024 + len(body_bytes))
 	req_buf.Grow(1024 + len(req_bytes))
 
 	body_buf.Write(body_bytes)
 	req_buf.Write(req_bytes)
 
-	// Extract Headers
-	eo_reqline := bytes.Index(req_bytes, []byte("\r\n"))
-
 	header_bytes := req_bytes[eo_reqline+2:]
 
 	header_str := string(header_bytes)
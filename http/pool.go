@@ -0,0 +1,276 @@
+package http
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MAX_IDLE_CONNS = 16
+	DEFAULT_IDLE_TIMEOUT   = 60 * time.Second
+)
+
+// PoolConfig bounds the connections of one upstream server. Zero values
+// fall back to the defaults, MaxPerHost zero means unlimited.
+type PoolConfig struct {
+	MaxIdle     int
+	MaxPerHost  int
+	IdleTimeout time.Duration
+}
+
+// ServerConns holds the pool settings of an upstream server and counts
+// its active connections, pooled, tunneled or carrying a PROXY header
+type ServerConns struct {
+	cfg PoolConfig
+
+	// One token per active connection, nil when MaxPerHost is unlimited
+	slots chan struct{}
+}
+
+func NewServerConns(cfg PoolConfig) *ServerConns {
+	conns := &ServerConns{cfg: cfg}
+
+	if cfg.MaxPerHost > 0 {
+		conns.slots = make(chan struct{}, cfg.MaxPerHost)
+	}
+
+	return conns
+}
+
+// acquire waits at most timeout for a free slot
+func (s *ServerConns) acquire(address string, timeout time.Duration) error {
+	if s == nil || s.slots == nil {
+		return nil
+	}
+
+	if timeout <= 0 {
+		s.slots <- struct{}{}
+		return nil
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-time.After(timeout):
+		return &poolTimeoutError{address: address}
+	}
+}
+
+func (s *ServerConns) release() {
+	if s != nil && s.slots != nil {
+		<-s.slots
+	}
+}
+
+// ConnPool keeps idle keep-alive connections per upstream server
+type ConnPool struct {
+	mu    sync.Mutex
+	hosts map[poolKey]*hostPool
+}
+
+type hostPool struct {
+	cfg  PoolConfig
+	idle []idleConn
+}
+
+type idleConn struct {
+	conn       net.Conn
+	idle_since time.Time
+}
+
+// poolKey keeps TLS connections apart from plain ones to the same address,
+// and from those made with other TLS settings or for another server
+type poolKey struct {
+	address string
+	tls     *tls.Config
+	server  *ServerConns
+}
+
+var DefaultPool = NewConnPool()
+
+func NewConnPool() *ConnPool {
+	return &ConnPool{
+		hosts: make(map[poolKey]*hostPool),
+	}
+}
+
+func (p *ConnPool) host(key poolKey) *hostPool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if hp, ok := p.hosts[key]; ok {
+		return hp
+	}
+
+	cfg := PoolConfig{}
+	if key.server != nil {
+		cfg = key.server.cfg
+	}
+
+	if cfg.MaxIdle <= 0 {
+		cfg.MaxIdle = DEFAULT_MAX_IDLE_CONNS
+	}
+
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = DEFAULT_IDLE_TIMEOUT
+	}
+
+	hp := &hostPool{cfg: cfg}
+	p.hosts[key] = hp
+
+	return hp
+}
+
+// Get returns an idle connection to address, or dials a new one, over TLS
+// when tls_cfg is set, counted as active for server. reused tells whether
+// the connection already carried a request.
+func (p *ConnPool) Get(address string, timeout time.Duration, tls_cfg *tls.Config, server *ServerConns) (conn net.Conn, reused bool, err error) {
+	hp := p.host(poolKey{address: address, tls: tls_cfg, server: server})
+
+	if err := server.acquire(address, timeout); err != nil {
+		return nil, false, err
+	}
+
+	for {
+		p.mu.Lock()
+		if len(hp.idle) == 0 {
+			p.mu.Unlock()
+			break
+		}
+
+		// Most recently used first, the oldest ones are the likeliest to be closed
+		last := hp.idle[len(hp.idle)-1]
+		hp.idle = hp.idle[:len(hp.idle)-1]
+		p.mu.Unlock()
+
+		if time.Since(last.idle_since) > hp.cfg.IdleTimeout || isStale(last.conn) {
+			last.conn.Close()
+			continue
+		}
+
+		return last.conn, true, nil
+	}
+
+	conn, err = dialUpstream(address, timeout, nil, tls_cfg)
+
+	if err != nil {
+		server.release()
+		return nil, false, err
+	}
+
+	return conn, false, nil
+}
+
+// Put gives a connection back after an exchange. Connections that cannot
+// carry another request, or that exceed MaxIdle, are closed.
+func (p *ConnPool) Put(address string, tls_cfg *tls.Config, server *ServerConns, conn net.Conn, reusable bool) {
+	hp := p.host(poolKey{address: address, tls: tls_cfg, server: server})
+	defer server.release()
+
+	if !reusable {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Drop connections that outlived the idle timeout
+	now := time.Now()
+	alive := hp.idle[:0]
+
+	for _, idle := range hp.idle {
+		if now.Sub(idle.idle_since) > hp.cfg.IdleTimeout {
+			idle.conn.Close()
+			continue
+		}
+		alive = append(alive, idle)
+	}
+
+	hp.idle = alive
+
+	if len(hp.idle) >= hp.cfg.MaxIdle {
+		conn.Close()
+		return
+	}
+
+	hp.idle = append(hp.idle, idleConn{conn: conn, idle_since: now})
+}
+
+// dialCounted dials a connection outside the pool, counted as active for
+// server until it is closed
+func dialCounted(address string, timeout time.Duration, proxy_protocol []byte, tls_cfg *tls.Config, server *ServerConns) (net.Conn, error) {
+	if err := server.acquire(address, timeout); err != nil {
+		return nil, err
+	}
+
+	conn, err := dialUpstream(address, timeout, proxy_protocol, tls_cfg)
+
+	if err != nil {
+		server.release()
+		return nil, err
+	}
+
+	if server == nil || server.slots == nil {
+		return conn, nil
+	}
+
+	return &countedConn{Conn: conn, server: server}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	server *ServerConns
+	once   sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(c.server.release)
+	return c.Conn.Close()
+}
+
+// isReusable tells whether the connection that carried req and res can be
+// handed to another request
+func isReusable(req HttpReq, res *HttpRes) bool {
+	if HasConnectionToken(req.Headers, "close") || HasConnectionToken(res.Headers, "close") {
+		return false
+	}
+
+	if res.Version == V1_0 && !HasConnectionToken(res.Headers, "keep-alive") {
+		return false
+	}
+
+	// Chunked bodies are not decoded, what is left of them would be read as the next response
+	if res.Headers["transfer-encoding"] != "" {
+		return false
+	}
+
+	// Without a length the body is delimited by the upstream closing the connection
+	return IsBodyless(req.Method, res.Status) || res.Headers["content-length"] != ""
+}
+
+// HasConnectionToken looks for token in the comma separated Connection header
+func HasConnectionToken(headers map[string]string, token string) bool {
+	for _, value := range strings.Split(headers["connection"], ",") {
+		if strings.EqualFold(strings.TrimSpace(value), token) {
+			return true
+		}
+	}
+	return false
+}
+
+type poolTimeoutError struct {
+	address string
+}
+
+func (e *poolTimeoutError) Error() string {
+	return "timed out waiting for a free connection to " + e.address
+}
+
+func (e *poolTimeoutError) Timeout() bool   { return true }
+func (e *poolTimeoutError) Temporary() bool { return true }
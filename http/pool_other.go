@@ -0,0 +1,11 @@
+//go:build !unix
+
+package http
+
+import "net"
+
+// isStale cannot peek at idle sockets here, a reused connection closed by
+// the upstream is caught by the retry of HandleRequest instead
+func isStale(conn net.Conn) bool {
+	return false
+}
@@ -0,0 +1,396 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUpstream serves canned responses, counting accepted connections
+func startUpstream(t *testing.T, res string) (string, int, *atomic.Int32) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := &atomic.Int32{}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					if _, err := ReadFullHttpMessage(c); err != nil {
+						return
+					}
+					c.Write([]byte(res))
+					if strings.Contains(res, "Connection: close") {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, accepted
+}
+
+func TestPoolReusesKeepAliveConnections(t *testing.T) {
+	host, port, accepted := startUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+
+	for i := 0; i < 3; i++ {
+		res, err := Get(host, port, "/", RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res.Body) != "ok" {
+			t.Fatalf("unexpected body %q", res.Body)
+		}
+	}
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected 1 upstream connection, got %d", n)
+	}
+}
+
+func TestPoolClosesOnConnectionClose(t *testing.T) {
+	host, port, accepted := startUpstream(t, "HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 2\r\n\r\nok")
+
+	for i := 0; i < 3; i++ {
+		if _, err := Get(host, port, "/", RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := accepted.Load(); n != 3 {
+		t.Errorf("expected 3 upstream connections, got %d", n)
+	}
+
+	address := net.JoinHostPort(host, fmt.Sprint(port))
+	if idle := len(DefaultPool.host(poolKey{address: address}).idle); idle != 0 {
+		t.Errorf("closed connections were pooled: %d idle", idle)
+	}
+}
+
+func TestPoolDropsStaleConnections(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				ReadFullHttpMessage(c)
+				// Answer as keep-alive, then close the idle connection anyway
+				c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				c.Close()
+			}(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+
+	for i := 0; i < 2; i++ {
+		if _, err := Post(addr.IP.String(), addr.Port, "/", RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}}}); err != nil {
+			t.Fatalf("request %d failed on a stale connection: %v", i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolReusesUnixSocketConnections(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := &atomic.Int32{}
+	hosts := make(chan string, 3)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					raw, err := ReadFullHttpMessage(c)
+					if err != nil {
+						return
+					}
+					req, _ := ParseRawHttpReq(raw)
+					hosts <- req.Headers["host"]
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				}
+			}(conn)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		res, err := Get(UNIX_PREFIX+socket, 0, "/", RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res.Body) != "ok" {
+			t.Fatalf("unexpected body %q", res.Body)
+		}
+		if host := <-hosts; host != "localhost" {
+			t.Errorf("expected Host localhost, got %q", host)
+		}
+	}
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected 1 socket connection, got %d", n)
+	}
+}
+
+func TestPoolReusesTLSConnections(t *testing.T) {
+	accepted := &atomic.Int32{}
+
+	server := httptest.NewUnstartedServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state nethttp.ConnState) {
+		if state == nethttp.StateNew {
+			accepted.Add(1)
+		}
+	}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	addr := server.Listener.Addr().(*net.TCPAddr)
+	timeouts := Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	tls_cfg := &tls.Config{RootCAs: roots, ServerName: "example.com"}
+
+	for i := 0; i < 3; i++ {
+		res, err := Get(addr.IP.String(), addr.Port, "/", RequestConfig{Transport: Transport{Timeouts: timeouts, TLS: tls_cfg}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res.Body) != "ok" {
+			t.Fatalf("unexpected body %q", res.Body)
+		}
+	}
+
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("expected 1 upstream connection, got %d", n)
+	}
+
+	// The test certificate is not trusted by the system
+	_, err := Get(addr.IP.String(), addr.Port, "/", RequestConfig{Transport: Transport{Timeouts: timeouts, TLS: &tls.Config{ServerName: "example.com"}}})
+	if err == nil {
+		t.Error("expected an untrusted certificate to fail")
+	}
+}
+
+// startFlakyUpstream answers the first request of each connection, then
+// handles the second one with second, counting the requests received
+func startFlakyUpstream(t *testing.T, second func(c net.Conn)) (string, int, *atomic.Int32) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	requests := &atomic.Int32{}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+
+				if _, err := ReadFullHttpMessage(c); err != nil {
+					return
+				}
+				requests.Add(1)
+				c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+
+				if _, err := ReadFullHttpMessage(c); err != nil {
+					return
+				}
+				requests.Add(1)
+				second(c)
+			}(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, requests
+}
+
+func TestRetriesReusedConnectionClosedBeforeResponse(t *testing.T) {
+	// Closed as the request arrives, nothing was answered
+	host, port, requests := startFlakyUpstream(t, func(c net.Conn) {})
+	cfg := RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := Get(host, port, "/", cfg); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+
+	// The second GET went to the reused connection, then to a fresh one
+	if n := requests.Load(); n != 3 {
+		t.Errorf("expected 3 requests upstream, got %d", n)
+	}
+}
+
+func TestDoesNotRetryTimeouts(t *testing.T) {
+	// Never answered
+	host, port, requests := startFlakyUpstream(t, func(c net.Conn) { time.Sleep(2 * time.Second) })
+	cfg := RequestConfig{Transport: Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: 200 * time.Millisecond}}}
+
+	if _, err := Get(host, port, "/", cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err := Get(host, port, "/", cfg)
+
+	if !IsTimeout(err) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("timed out after %s, the request was retried", elapsed)
+	}
+
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 requests upstream, got %d", n)
+	}
+}
+
+func TestServerConnsCapsActiveConnections(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	var active, max_active atomic.Int32
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+				for {
+					raw, err := ReadFullHttpMessage(c)
+					if err != nil {
+						return
+					}
+
+					if strings.Contains(strings.ToLower(raw), "upgrade: test") {
+						c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+						io.Copy(io.Discard, c)
+						return
+					}
+
+					n := active.Add(1)
+					for m := max_active.Load(); n > m && !max_active.CompareAndSwap(m, n); m = max_active.Load() {
+					}
+					time.Sleep(50 * time.Millisecond)
+					active.Add(-1)
+
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+				}
+			}(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	timeouts := Timeouts{Connect: 5 * time.Second, Send: time.Second, Read: time.Second}
+	server := NewServerConns(PoolConfig{MaxPerHost: 2})
+
+	errs := make(chan error, 6)
+
+	for i := 0; i < 6; i++ {
+		transport := Transport{Timeouts: timeouts, Conns: server}
+
+		// Connections carrying a PROXY header are dialed outside the pool
+		if i%2 == 1 {
+			transport.ProxyProtocol = []byte("PROXY TCP4 192.0.2.1 127.0.0.1 1234 80\r\n")
+		}
+
+		go func() {
+			_, err := Get(addr.IP.String(), addr.Port, "/", RequestConfig{Transport: transport})
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := max_active.Load(); n > 2 {
+		t.Errorf("expected at most 2 concurrent requests, got %d", n)
+	}
+
+	// A tunnel holds its slot until it is closed
+	server = NewServerConns(PoolConfig{MaxPerHost: 1})
+	short := Transport{Timeouts: Timeouts{Connect: 100 * time.Millisecond, Send: time.Second, Read: time.Second}, Conns: server}
+
+	upgrade_req := HttpReq{Version: string(V1_1), Method: "GET", Target: "/", Headers: map[string]string{"host": "example.com"}}
+	UpgradeHeaders(upgrade_req.Headers, "test")
+	res, tunnel, err := Upgrade(upgrade_req, addr.IP.String(), addr.Port, short)
+	if err != nil || res.Status != StatusSwitchingProtocols {
+		t.Fatalf("upgrade failed: %v %v", res, err)
+	}
+
+	if _, err := Get(addr.IP.String(), addr.Port, "/", RequestConfig{Transport: short}); !IsTimeout(err) {
+		t.Errorf("expected a timeout while the tunnel is open, got %v", err)
+	}
+
+	tunnel.Close()
+	tunnel.Close()
+
+	if _, err := Get(addr.IP.String(), addr.Port, "/", RequestConfig{Transport: short}); err != nil {
+		t.Errorf("request after closing the tunnel failed: %v", err)
+	}
+}
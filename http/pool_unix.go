@@ -0,0 +1,43 @@
+//go:build unix
+
+package http
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+)
+
+// isStale reports whether an idle connection was closed by the upstream or
+// has unsolicited bytes pending, in both cases it cannot carry a new
+// request. The socket is read without waiting for it.
+func isStale(conn net.Conn) bool {
+	if tls_conn, ok := conn.(*tls.Conn); ok {
+		conn = tls_conn.NetConn()
+	}
+
+	sys_conn, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
+	}
+
+	raw, err := sys_conn.SyscallConn()
+	if err != nil {
+		return true
+	}
+
+	stale := false
+
+	err = raw.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		_, read_err := syscall.Read(int(fd), buf[:])
+
+		// Only "nothing to read yet" means alive, data or EOF do not
+		stale = read_err != syscall.EAGAIN && read_err != syscall.EWOULDBLOCK && read_err != syscall.EINTR
+
+		// Done, do not wait for the socket to be readable
+		return true
+	})
+
+	return stale || err != nil
+}
@@ -0,0 +1,83 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SCGI client, see https://python.ca/scgi/protocol.txt
+
+// Responses of SCGI and uwsgi servers are buffered up to this size
+const MAX_GATEWAY_RESPONSE_SIZE = 64 << 20
+
+// EncodeSCGIRequest writes the variables as a netstring, CONTENT_LENGTH
+// first, then the body
+func EncodeSCGIRequest(env map[string]string, body []byte) []byte {
+	var headers bytes.Buffer
+
+	writeSCGIHeader(&headers, "CONTENT_LENGTH", fmt.Sprint(len(body)))
+	writeSCGIHeader(&headers, "SCGI", "1")
+
+	for _, name := range sortedNames(env) {
+		if name == "CONTENT_LENGTH" || name == "SCGI" {
+			continue
+		}
+		writeSCGIHeader(&headers, name, env[name])
+	}
+
+	var buf bytes.Buffer
+
+	buf.Grow(headers.Len() + len(body) + 8)
+	fmt.Fprintf(&buf, "%d:", headers.Len())
+	buf.Write(headers.Bytes())
+	buf.WriteByte(',')
+	buf.Write(body)
+
+	return buf.Bytes()
+}
+
+func writeSCGIHeader(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	buf.WriteString(value)
+	buf.WriteByte(0)
+}
+
+// SCGIRoundTrip sends a request on conn, used for this request only
+func SCGIRoundTrip(conn io.ReadWriter, env map[string]string, body []byte) (*HttpRes, error) {
+	if _, err := conn.Write(EncodeSCGIRequest(env, body)); err != nil {
+		return nil, err
+	}
+
+	return readGatewayResponse(conn)
+}
+
+// readGatewayResponse reads until the server closes the connection
+func readGatewayResponse(conn io.Reader) (*HttpRes, error) {
+	raw, err := io.ReadAll(io.LimitReader(conn, MAX_GATEWAY_RESPONSE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) > MAX_GATEWAY_RESPONSE_SIZE {
+		return nil, fmt.Errorf("response exceeds %d bytes", MAX_GATEWAY_RESPONSE_SIZE)
+	}
+
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return ParseGatewayResponse(raw)
+}
+
+func sortedNames(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
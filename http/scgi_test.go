@@ -0,0 +1,127 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startGateway serves a single request on each connection with handle,
+// which reads it from r and answers on c before the connection is closed
+func startGateway(t *testing.T, handle func(r *bufio.Reader, c net.Conn)) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+				handle(bufio.NewReader(c), c)
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// readSCGIRequest is the server side of EncodeSCGIRequest
+func readSCGIRequest(r *bufio.Reader) ([]string, []byte, error) {
+	raw_length, err := r.ReadString(':')
+	if err != nil {
+		return nil, nil, err
+	}
+
+	length, err := strconv.Atoi(raw_length[:len(raw_length)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	netstring := make([]byte, length+1)
+	if _, err := io.ReadFull(r, netstring); err != nil || netstring[length] != ',' {
+		return nil, nil, fmt.Errorf("invalid netstring")
+	}
+
+	fields := bytes.Split(bytes.TrimSuffix(netstring[:length], []byte{0}), []byte{0})
+	headers := make([]string, len(fields))
+	for i, field := range fields {
+		headers[i] = string(field)
+	}
+
+	content_length, _ := strconv.Atoi(headers[1])
+	body := make([]byte, content_length)
+	_, err = io.ReadFull(r, body)
+
+	return headers, body, err
+}
+
+func TestSCGIRoundTrip(t *testing.T) {
+	addr := startGateway(t, func(r *bufio.Reader, c net.Conn) {
+		headers, body, err := readSCGIRequest(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// CONTENT_LENGTH comes first, then SCGI
+		if headers[0] != "CONTENT_LENGTH" || headers[2] != "SCGI" || headers[3] != "1" {
+			t.Errorf("unexpected headers %q", headers)
+		}
+
+		vars := map[string]string{}
+		for i := 0; i+1 < len(headers); i += 2 {
+			vars[headers[i]] = headers[i+1]
+		}
+
+		fmt.Fprintf(c, "Status: 202 Accepted\r\nContent-Type: text/plain\r\n\r\n%s %s %s", vars["REQUEST_METHOD"], vars["PATH_INFO"], body)
+	})
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	res, err := SCGIRoundTrip(conn, map[string]string{
+		"REQUEST_METHOD": "POST",
+		"PATH_INFO":      "/jobs",
+		"CONTENT_LENGTH": "ignored",
+	}, []byte("payload"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Status != StatusAccepted || string(res.Body) != "POST /jobs payload" || res.Headers["content-length"] != "18" {
+		t.Errorf("got %d %q %q", res.Status, res.Body, res.Headers)
+	}
+}
+
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func TestReadGatewayResponseTooLarge(t *testing.T) {
+	raw := io.MultiReader(strings.NewReader("Status: 200 OK\r\n\r\n"), endlessReader{})
+
+	if res, err := readGatewayResponse(raw); err == nil {
+		t.Errorf("expected an error, got %d bytes", len(res.Body))
+	}
+}
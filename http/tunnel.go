@@ -0,0 +1,126 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IsUpgradeRequest tells whether the client asks to switch protocols,
+// e.g. to WebSocket
+func IsUpgradeRequest(headers map[string]string) bool {
+	return headers["upgrade"] != "" && HasConnectionToken(headers, "upgrade")
+}
+
+// Upgrade sends an upgrade request to host:port on a dedicated connection.
+// When the upstream agrees with a 101 the connection is returned, ready to
+// be spliced with the client one, otherwise it is closed and only the
+// response is returned.
+func Upgrade(req HttpReq, host string, port int, transport Transport) (*HttpRes, net.Conn, error) {
+	timeouts := transport.Timeouts
+
+	connection, err := dialCounted(Address(host, port), timeouts.Connect, transport.ProxyProtocol, transport.TLS, transport.Conns)
+
+	if err != nil {
+		return nil, nil, &ConnectError{Err: err}
+	}
+
+	res, err := roundTrip(&timeoutConn{Conn: connection, timeouts: timeouts}, req)
+
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+
+	if res.Status != StatusSwitchingProtocols {
+		connection.Close()
+		return res, nil, nil
+	}
+
+	// Deadlines set by timeoutConn are lifted, Splice manages its own
+	connection.SetDeadline(time.Time{})
+
+	return res, connection, nil
+}
+
+// Splice copies bytes both ways between the client and the upstream until
+// either side closes or neither sent anything for idle. It returns the
+// bytes sent to the upstream and to the client.
+func Splice(client net.Conn, upstream net.Conn, idle time.Duration) (int64, int64, error) {
+	var last_activity atomic.Int64
+	last_activity.Store(time.Now().UnixNano())
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var splice_err error
+
+	var sent, received int64
+
+	pipe := func(dst net.Conn, src net.Conn, written *int64) {
+		defer wg.Done()
+
+		n, err := io.Copy(dst, &idleReader{conn: src, idle: idle, last_activity: &last_activity})
+		*written = n
+
+		// The first side to stop ends the tunnel
+		once.Do(func() {
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				splice_err = err
+			}
+			client.Close()
+			upstream.Close()
+		})
+	}
+
+	wg.Add(2)
+	go pipe(upstream, client, &sent)
+	go pipe(client, upstream, &received)
+	wg.Wait()
+
+	return sent, received, splice_err
+}
+
+// idleReader reads from a tunnel end, timing out only when both directions
+// have been quiet for idle
+type idleReader struct {
+	conn          net.Conn
+	idle          time.Duration
+	last_activity *atomic.Int64
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	for {
+		if r.idle > 0 {
+			last := time.Unix(0, r.last_activity.Load())
+			r.conn.SetReadDeadline(last.Add(r.idle))
+		}
+
+		n, err := r.conn.Read(p)
+
+		if n > 0 {
+			r.last_activity.Store(time.Now().UnixNano())
+		}
+
+		// The other direction may have been active in the meantime
+		if errors.Is(err, os.ErrDeadlineExceeded) && n == 0 {
+			last := time.Unix(0, r.last_activity.Load())
+			if time.Since(last) < r.idle {
+				continue
+			}
+		}
+
+		return n, err
+	}
+}
+
+// UpgradeHeaders restores the Connection and Upgrade headers stripped as
+// hop-by-hop, so the upstream sees the handshake
+func UpgradeHeaders(headers map[string]string, upgrade string) {
+	headers["connection"] = "upgrade"
+	headers["upgrade"] = strings.TrimSpace(upgrade)
+}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEchoUpgrade switches protocols then echoes everything back
+func startEchoUpgrade(t *testing.T) (string, int) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+				if _, err := ReadFullHttpMessage(c); err != nil {
+					return
+				}
+				c.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+				io.Copy(c, c)
+			}(conn)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+// clientPair returns both ends of a TCP connection
+func clientPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client, server
+}
+
+func upgradeEcho(t *testing.T) net.Conn {
+	host, port := startEchoUpgrade(t)
+
+	req := HttpReq{
+		Version: string(V1_1),
+		Method:  "GET",
+		Target:  "/ws",
+		Headers: map[string]string{"host": host},
+	}
+	UpgradeHeaders(req.Headers, "echo")
+
+	res, conn, err := Upgrade(req, host, port, Transport{Timeouts: Timeouts{Connect: time.Second, Send: time.Second, Read: time.Second}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != StatusSwitchingProtocols || conn == nil {
+		t.Fatalf("expected a 101 and a connection, got %d", res.Status)
+	}
+
+	return conn
+}
+
+func TestSpliceRelaysBothWays(t *testing.T) {
+	upstream := upgradeEcho(t)
+	client, proxy_side := clientPair(t)
+
+	done := make(chan struct{})
+	go func() {
+		Splice(proxy_side, upstream, time.Second)
+		close(done)
+	}()
+
+	client.Write([]byte("ping"))
+
+	buf := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected ping back, got %q (%v)", buf, err)
+	}
+
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("tunnel still open after the client closed")
+	}
+}
+
+func TestSpliceIdleTimeout(t *testing.T) {
+	upstream := upgradeEcho(t)
+	client, proxy_side := clientPair(t)
+	defer client.Close()
+
+	start := time.Now()
+	_, _, err := Splice(proxy_side, upstream, 100*time.Millisecond)
+
+	if !IsTimeout(err) {
+		t.Errorf("expected an idle timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("idle tunnel closed after %s", elapsed)
+	}
+}
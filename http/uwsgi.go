@@ -0,0 +1,68 @@
+package http
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+)
+
+// uwsgi client, see https://uwsgi-docs.readthedocs.io/en/latest/Protocol.html
+
+// Packet modifier of WSGI requests, a vars block followed by the body
+const UWSGI_MODIFIER_WSGI = 0
+
+// EncodeUWSGIRequest writes the header, the variables, then the body
+func EncodeUWSGIRequest(env map[string]string, body []byte) ([]byte, error) {
+	env = maps.Clone(env)
+	if env == nil {
+		env = map[string]string{}
+	}
+	env["CONTENT_LENGTH"] = fmt.Sprint(len(body))
+
+	var vars bytes.Buffer
+
+	for _, name := range sortedNames(env) {
+		value := env[name]
+
+		if len(name) > math.MaxUint16 || len(value) > math.MaxUint16 {
+			return nil, fmt.Errorf("uwsgi: variable %s too long", name)
+		}
+
+		binary.Write(&vars, binary.LittleEndian, uint16(len(name)))
+		vars.WriteString(name)
+		binary.Write(&vars, binary.LittleEndian, uint16(len(value)))
+		vars.WriteString(value)
+	}
+
+	if vars.Len() > math.MaxUint16 {
+		return nil, fmt.Errorf("uwsgi: variables exceed %d bytes", math.MaxUint16)
+	}
+
+	var buf bytes.Buffer
+
+	buf.Grow(4 + vars.Len() + len(body))
+	buf.WriteByte(UWSGI_MODIFIER_WSGI)
+	binary.Write(&buf, binary.LittleEndian, uint16(vars.Len()))
+	buf.WriteByte(0)
+	buf.Write(vars.Bytes())
+	buf.Write(body)
+
+	return buf.Bytes(), nil
+}
+
+// UWSGIRoundTrip sends a request on conn, used for this request only
+func UWSGIRoundTrip(conn io.ReadWriter, env map[string]string, body []byte) (*HttpRes, error) {
+	packet, err := EncodeUWSGIRequest(env, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+
+	return readGatewayResponse(conn)
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readUWSGIRequest is the server side of EncodeUWSGIRequest
+func readUWSGIRequest(r *bufio.Reader) (map[string]string, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+
+	if header[0] != UWSGI_MODIFIER_WSGI {
+		return nil, nil, fmt.Errorf("unexpected modifier %d", header[0])
+	}
+
+	packet := make([]byte, binary.LittleEndian.Uint16(header[1:3]))
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, nil, err
+	}
+
+	vars := map[string]string{}
+
+	for len(packet) > 0 {
+		name_len := binary.LittleEndian.Uint16(packet)
+		name := string(packet[2 : 2+name_len])
+		packet = packet[2+name_len:]
+
+		value_len := binary.LittleEndian.Uint16(packet)
+		vars[name] = string(packet[2 : 2+value_len])
+		packet = packet[2+value_len:]
+	}
+
+	content_length, _ := strconv.Atoi(vars["CONTENT_LENGTH"])
+	body := make([]byte, content_length)
+	_, err := io.ReadFull(r, body)
+
+	return vars, body, err
+}
+
+func TestUWSGIRoundTrip(t *testing.T) {
+	long := strings.Repeat("v", 300)
+
+	addr := startGateway(t, func(r *bufio.Reader, c net.Conn) {
+		vars, body, err := readUWSGIRequest(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if vars["HTTP_X_LONG"] != long {
+			t.Errorf("HTTP_X_LONG not passed")
+		}
+
+		// uWSGI answers with a status line
+		fmt.Fprintf(c, "HTTP/1.1 201 Created\r\nContent-Type: text/plain\r\nLocation: /items/1\r\n\r\n%s %s", vars["REQUEST_METHOD"], body)
+	})
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	env := map[string]string{"REQUEST_METHOD": "PUT", "HTTP_X_LONG": long}
+
+	res, err := UWSGIRoundTrip(conn, env, []byte("item"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Status != StatusCreated || res.Headers["location"] != "/items/1" || string(res.Body) != "PUT item" {
+		t.Errorf("got %d %q %q", res.Status, res.Body, res.Headers)
+	}
+
+	if _, ok := env["CONTENT_LENGTH"]; ok {
+		t.Errorf("env of the caller modified")
+	}
+}
+
+func TestEncodeUWSGIRequestTooLarge(t *testing.T) {
+	env := map[string]string{}
+	for i := range 300 {
+		env[fmt.Sprintf("HTTP_X_%d", i)] = strings.Repeat("v", 250)
+	}
+
+	if _, err := EncodeUWSGIRequest(env, nil); err == nil {
+		t.Errorf("variables over 64k encoded")
+	}
+}
@@ -26,6 +26,17 @@ const (
 	REQUEST           LogEvent = "REQUEST"
 	REQ_READING_ERROR LogEvent = "REQ_READING_ERROR"
 	REQ_PARSE_ERROR   LogEvent = "REQ_PARSE_ERROR"
+	UPSTREAM_UP       LogEvent = "UPSTREAM_UP"
+	UPSTREAM_DOWN     LogEvent = "UPSTREAM_DOWN"
+	UPSTREAM_EJECTED  LogEvent = "UPSTREAM_EJECTED"
+	UPSTREAM_PROBING  LogEvent = "UPSTREAM_PROBING"
+	UPSTREAM_RESTORED LogEvent = "UPSTREAM_RESTORED"
+	UPSTREAM_ERROR    LogEvent = "UPSTREAM_ERROR"
+	TUNNEL_CLOSED     LogEvent = "TUNNEL_CLOSED"
+	CACHE_ERROR       LogEvent = "CACHE_ERROR"
+	MIRROR_REQUEST    LogEvent = "MIRROR_REQUEST"
+	MIRROR_ERROR      LogEvent = "MIRROR_ERROR"
+	MIRROR_DROPPED    LogEvent = "MIRROR_DROPPED"
 )
 
 func (event *LogEvent) ToStr() string {
@@ -37,6 +48,9 @@ type Service string
 const (
 	DREAM_SERVER Service = "DREAM_SERVER"
 	HTTP_PARSER  Service = "HTTP_PARSER"
+	HEALTH_CHECK Service = "HEALTH_CHECK"
+	UPSTREAM     Service = "UPSTREAM"
+	MIRROR       Service = "MIRROR"
 )
 
 func (service *Service) ToStr() string {
@@ -84,7 +98,7 @@ func NewRequestLog(service Service, level LogLevel, event LogEvent, message stri
 }
 
 func (rl RequestLog) ToText() string {
-	return fmt.Sprintf(
+	text := fmt.Sprintf(
 		"[%s][%s][%s] %s -> \"%s %s%s\" %d %dB %dms: %s",
 		rl.Timestamp,
 		rl.Service,
@@ -98,6 +112,12 @@ func (rl RequestLog) ToText() string {
 		rl.Response.LatencyMS,
 		rl.Message,
 	)
+
+	if rl.Trace.UpstreamIP != "" {
+		text += fmt.Sprintf(" upstream=%s upstream_latency=%dms", rl.Trace.UpstreamIP, rl.Trace.UpstreamLatencyMS)
+	}
+
+	return text
 }
 
 func (rl RequestLog) ToJSON() string {
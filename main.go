@@ -1,8 +1,10 @@
 package main
 
 import (
+	"dreamproxy/cache"
 	"dreamproxy/config"
 	"dreamproxy/dream"
+	"dreamproxy/upstream"
 	"strconv"
 )
 
@@ -15,6 +17,11 @@ func main() {
 	ctxts := []dream.DreamContext{}
 	dreamconfig = config.LoadDreamFile(CONFIG_FILE)
 
+	upstream.Init(dreamconfig.Upstreams)
+	dream.SetUpstreamCheckTLS(dreamconfig.Servers)
+	upstream.StartHealthChecks()
+	cache.Init(dreamconfig.Caches)
+
 	config_map := map[string][]config.Server{}
 
 	// Map each server configuration to a unique port
@@ -0,0 +1,185 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// HAProxy PROXY protocol, see https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+
+var V2_SIGNATURE = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// Longest possible v1 header, CRLF included
+	V1_MAX_LENGTH = 107
+
+	V2_CMD_LOCAL = 0x0
+	V2_CMD_PROXY = 0x1
+
+	V2_FAM_UNSPEC = 0x0
+	V2_FAM_INET   = 0x1
+	V2_FAM_INET6  = 0x2
+	V2_FAM_UNIX   = 0x3
+)
+
+type Header struct {
+	Version int
+
+	// Nil for LOCAL (v2) and UNKNOWN (v1) connections, e.g. health checks
+	// of the balancer, where the real connection addresses apply
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// ReadHeader consumes the PROXY protocol header at the start of a
+// connection, reading nothing past it
+func ReadHeader(r io.Reader) (*Header, error) {
+	// Both signatures fit in the shortest possible header ("PROXY UNKNOWN\r\n")
+	start := make([]byte, len(V2_SIGNATURE))
+
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, V2_SIGNATURE) {
+		return readV2(r)
+	}
+
+	if bytes.HasPrefix(start, []byte("PROXY ")) {
+		return readV1(r, start)
+	}
+
+	return nil, fmt.Errorf("missing PROXY protocol header")
+}
+
+func readV1(r io.Reader, start []byte) (*Header, error) {
+	line := bytes.NewBuffer(start)
+	b := make([]byte, 1)
+
+	for !bytes.HasSuffix(line.Bytes(), []byte("\r\n")) {
+		if line.Len() >= V1_MAX_LENGTH {
+			return nil, fmt.Errorf("PROXY v1 header too long")
+		}
+
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		line.Write(b)
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(line.String(), "\r\n"))
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: 1}, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line.String())
+	}
+
+	src, err := parseV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := parseV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{Version: 1, Source: src, Destination: dst}, nil
+}
+
+func parseV1Addr(ip_str string, port_str string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(ip_str)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid PROXY v1 address %q", ip_str)
+	}
+
+	port, err := strconv.Atoi(port_str)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY v1 port %q", port_str)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readV2(r io.Reader) (*Header, error) {
+	// ver_cmd, fam, len(2)
+	meta := make([]byte, 4)
+
+	if _, err := io.ReadFull(r, meta); err != nil {
+		return nil, err
+	}
+
+	version := meta[0] >> 4
+	command := meta[0] & 0x0F
+	family := meta[1] >> 4
+	length := binary.BigEndian.Uint16(meta[2:])
+
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Version: 2}
+
+	switch command {
+	case V2_CMD_LOCAL:
+		return header, nil
+	case V2_CMD_PROXY:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", command)
+	}
+
+	switch family {
+	case V2_FAM_INET:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 addresses")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case V2_FAM_INET6:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 addresses")
+		}
+		header.Source = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		header.Destination = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	default:
+		// Unix sockets and unspecified families carry no usable client address,
+		// TLVs after the addresses are ignored
+	}
+
+	return header, nil
+}
+
+// FormatV1 builds the v1 header announcing a connection from src to dst
+func FormatV1(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	// Both ends have to share a family
+	proto := ""
+	switch {
+	case src.IP.To4() != nil && dst.IP.To4() != nil:
+		proto = "TCP4"
+	case src.IP.To4() == nil && dst.IP.To4() == nil:
+		proto = "TCP6"
+	default:
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.IP.String(), dst.IP.String(), src.Port, dst.Port))
+}
@@ -0,0 +1,126 @@
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func v2Header(command byte, family byte, addrs []byte) []byte {
+	header := append([]byte{}, V2_SIGNATURE...)
+	header = append(header, 0x20|command, family<<4|0x1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestReadHeader(t *testing.T) {
+	inet := []byte{192, 0, 2, 1, 10, 0, 0, 1}
+	inet = binary.BigEndian.AppendUint16(inet, 51234)
+	inet = binary.BigEndian.AppendUint16(inet, 443)
+
+	inet6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	inet6 = binary.BigEndian.AppendUint16(inet6, 40000)
+	inet6 = binary.BigEndian.AppendUint16(inet6, 80)
+
+	tests := []struct {
+		name     string
+		raw      []byte
+		wantErr  bool
+		wantSrc  string
+		wantNone bool
+	}{
+		{
+			name:    "v1 TCP4",
+			raw:     []byte("PROXY TCP4 192.0.2.1 10.0.0.1 51234 443\r\n"),
+			wantSrc: "192.0.2.1:51234",
+		},
+		{
+			name:    "v1 TCP6",
+			raw:     []byte("PROXY TCP6 2001:db8::1 2001:db8::2 40000 80\r\n"),
+			wantSrc: "[2001:db8::1]:40000",
+		},
+		{
+			name:     "v1 UNKNOWN",
+			raw:      []byte("PROXY UNKNOWN\r\n"),
+			wantNone: true,
+		},
+		{
+			name:    "v1 bad port",
+			raw:     []byte("PROXY TCP4 192.0.2.1 10.0.0.1 99999 443\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "v1 without CRLF",
+			raw:     bytes.Repeat([]byte("PROXY "), 30),
+			wantErr: true,
+		},
+		{
+			name:    "v2 INET",
+			raw:     v2Header(V2_CMD_PROXY, V2_FAM_INET, inet),
+			wantSrc: "192.0.2.1:51234",
+		},
+		{
+			name:    "v2 INET6 with TLV",
+			raw:     v2Header(V2_CMD_PROXY, V2_FAM_INET6, append(inet6, 0x04, 0x00, 0x01, 0xFF)),
+			wantSrc: "[2001:db8::1]:40000",
+		},
+		{
+			name:     "v2 LOCAL",
+			raw:      v2Header(V2_CMD_LOCAL, V2_FAM_UNSPEC, nil),
+			wantNone: true,
+		},
+		{
+			name:    "v2 truncated",
+			raw:     v2Header(V2_CMD_PROXY, V2_FAM_INET, inet)[:20],
+			wantErr: true,
+		},
+		{
+			name:    "Plain HTTP",
+			raw:     []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The request following the header must be left unread
+			r := bytes.NewReader(append(tt.raw, []byte("GET /")...))
+
+			header, err := ReadHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if tt.wantNone && header.Source != nil {
+				t.Errorf("expected no source address, got %s", header.Source)
+			}
+			if tt.wantSrc != "" && (header.Source == nil || header.Source.String() != tt.wantSrc) {
+				t.Errorf("source = %v, want %s", header.Source, tt.wantSrc)
+			}
+
+			rest, _ := io.ReadAll(r)
+			if string(rest) != "GET /" {
+				t.Errorf("header reader consumed past the header, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestFormatV1RoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 5000}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8080}
+
+	header, err := ReadHeader(bytes.NewReader(FormatV1(src, dst)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Source.String() != src.String() || header.Destination.String() != dst.String() {
+		t.Errorf("round trip mismatch: %s -> %s", header.Source, header.Destination)
+	}
+}
@@ -0,0 +1,152 @@
+package upstream
+
+import (
+	"dreamproxy/logger"
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_FAIL_TIMEOUT       = 10 * time.Second
+	DEFAULT_HALF_OPEN_REQUESTS = 1
+)
+
+type BreakerState int
+
+const (
+	// Traffic flows normally and failures are counted
+	BreakerClosed BreakerState = iota
+	// Server is ejected until fail_timeout elapses
+	BreakerOpen
+	// A limited number of trial requests decide whether to reinstate the server
+	BreakerHalfOpen
+)
+
+func (state BreakerState) ToStr() string {
+	switch state {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type breaker struct {
+	max_fails          int
+	fail_timeout       time.Duration
+	half_open_requests int
+
+	state BreakerState
+
+	// Failures counted inside the current fail_timeout window
+	failures     int
+	window_start time.Time
+
+	opened_at time.Time
+
+	// Trial requests admitted and succeeded while half-open
+	trials    int
+	successes int
+}
+
+// admit reports whether the breaker lets a request through, moving an
+// open breaker to half-open once fail_timeout has elapsed.
+// Callers must hold the server lock.
+func (s *Server) admit(now time.Time) bool {
+	b := &s.breaker
+
+	if b.max_fails <= 0 {
+		return true
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		if now.Sub(b.opened_at) < b.fail_timeout {
+			return false
+		}
+
+		b.state = BreakerHalfOpen
+		b.trials = 0
+		b.successes = 0
+		logTransition(logger.UPSTREAM, logger.INFO, logger.UPSTREAM_PROBING, s.group, s.Address,
+			fmt.Sprintf("fail_timeout elapsed, letting %d trial requests through", b.half_open_requests))
+
+		fallthrough
+	case BreakerHalfOpen:
+		if b.trials >= b.half_open_requests {
+			return false
+		}
+
+		b.trials++
+		return true
+	default:
+		return true
+	}
+}
+
+// ReportSuccess records a request the server answered without error
+func (s *Server) ReportSuccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &s.breaker
+
+	if b.max_fails <= 0 || b.state != BreakerHalfOpen {
+		return
+	}
+
+	b.successes++
+
+	if b.successes >= b.half_open_requests {
+		b.state = BreakerClosed
+		b.failures = 0
+		logTransition(logger.UPSTREAM, logger.INFO, logger.UPSTREAM_RESTORED, s.group, s.Address,
+			fmt.Sprintf("server reinstated after %d successful trial requests", b.successes))
+	}
+}
+
+// ReportFailure records a connect error, timeout or 5xx response and
+// ejects the server once max_fails is reached within fail_timeout
+func (s *Server) ReportFailure(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &s.breaker
+	now := time.Now()
+
+	if b.max_fails <= 0 {
+		return
+	}
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.state = BreakerOpen
+		b.opened_at = now
+		logTransition(logger.UPSTREAM, logger.WARN, logger.UPSTREAM_EJECTED, s.group, s.Address,
+			fmt.Sprintf("trial request failed, ejected for %s: %s", b.fail_timeout, reason))
+	case BreakerClosed:
+		if now.Sub(b.window_start) > b.fail_timeout {
+			b.window_start = now
+			b.failures = 0
+		}
+
+		b.failures++
+
+		if b.failures >= b.max_fails {
+			b.state = BreakerOpen
+			b.opened_at = now
+			logTransition(logger.UPSTREAM, logger.WARN, logger.UPSTREAM_EJECTED, s.group, s.Address,
+				fmt.Sprintf("%d failures within %s, ejected: %s", b.failures, b.fail_timeout, reason))
+		}
+	}
+}
+
+// BreakerState returns the current circuit breaker state of the server
+func (s *Server) BreakerState() BreakerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.breaker.state
+}
@@ -0,0 +1,83 @@
+package upstream
+
+import (
+	"dreamproxy/config"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	group, err := NewUpstream(config.Upstream{
+		Name:             "backend",
+		Servers:          []config.UpstreamServer{{Address: "127.0.0.1:8000"}},
+		MaxFails:         2,
+		FailTimeout:      50 * time.Millisecond,
+		HalfOpenRequests: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := group.Servers[0]
+
+	server.ReportFailure("status 502")
+	if server.BreakerState() != BreakerClosed {
+		t.Fatalf("server ejected before max_fails")
+	}
+
+	server.ReportFailure("status 502")
+	if server.BreakerState() != BreakerOpen {
+		t.Fatalf("server not ejected after max_fails")
+	}
+
+	if _, err := group.Next(); err == nil {
+		t.Fatalf("ejected server was selected")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	// Two trial requests are let through, a third has to wait
+	for i := 0; i < 2; i++ {
+		if _, err := group.Next(); err != nil {
+			t.Fatalf("trial request %d rejected: %v", i, err)
+		}
+	}
+	if _, err := group.Next(); err == nil {
+		t.Fatalf("more trial requests than half_open_requests")
+	}
+	if server.BreakerState() != BreakerHalfOpen {
+		t.Fatalf("expected half-open, got %s", server.BreakerState().ToStr())
+	}
+
+	server.ReportSuccess()
+	server.ReportSuccess()
+	if server.BreakerState() != BreakerClosed {
+		t.Fatalf("server not reinstated after successful trials")
+	}
+}
+
+func TestCircuitBreakerHalfOpenFailure(t *testing.T) {
+	group, err := NewUpstream(config.Upstream{
+		Name:        "backend",
+		Servers:     []config.UpstreamServer{{Address: "127.0.0.1:8000"}},
+		MaxFails:    1,
+		FailTimeout: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := group.Servers[0]
+	server.ReportFailure("connection refused")
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, err := group.Next(); err != nil {
+		t.Fatalf("trial request rejected: %v", err)
+	}
+
+	server.ReportFailure("connection refused")
+	if server.BreakerState() != BreakerOpen {
+		t.Fatalf("failed trial should eject the server again")
+	}
+}
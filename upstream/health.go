@@ -0,0 +1,145 @@
+package upstream
+
+import (
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/logger"
+	"dreamproxy/proxyproto"
+	"fmt"
+	"time"
+)
+
+const (
+	DEFAULT_CHECK_INTERVAL = 5 * time.Second
+	DEFAULT_CHECK_TIMEOUT  = 2 * time.Second
+	DEFAULT_CHECK_PATH     = "/"
+	DEFAULT_CHECK_STATUS   = 200
+	DEFAULT_CHECK_RISE     = 2
+	DEFAULT_CHECK_FALL     = 3
+)
+
+func withDefaults(cfg config.HealthCheck) config.HealthCheck {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DEFAULT_CHECK_INTERVAL
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DEFAULT_CHECK_TIMEOUT
+	}
+	if cfg.Path == "" {
+		cfg.Path = DEFAULT_CHECK_PATH
+	}
+	if cfg.ExpectedStatus == 0 {
+		cfg.ExpectedStatus = DEFAULT_CHECK_STATUS
+	}
+	if cfg.Rise <= 0 {
+		cfg.Rise = DEFAULT_CHECK_RISE
+	}
+	if cfg.Fall <= 0 {
+		cfg.Fall = DEFAULT_CHECK_FALL
+	}
+	return cfg
+}
+
+// startHealthChecks probes every server of the group in the background,
+// but those configured down. Groups without a health check configured are
+// left alone.
+func (u *Upstream) startHealthChecks() {
+	if u.health == nil {
+		return
+	}
+
+	cfg := withDefaults(*u.health)
+
+	for _, server := range u.Servers {
+		if !server.down {
+			go u.runHealthCheck(server, cfg)
+		}
+	}
+}
+
+func (u *Upstream) runHealthCheck(server *Server, cfg config.HealthCheck) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+
+	transport := u.checkTransport(cfg)
+
+	for {
+		err := probe(server, cfg, transport)
+		server.recordCheck(u.Name, err, cfg)
+
+		<-ticker.C
+	}
+}
+
+// checkTransport reaches the servers the way requests do, with a PROXY
+// protocol header when the group expects one and over TLS for https groups
+func (u *Upstream) checkTransport(cfg config.HealthCheck) http.Transport {
+	transport := http.Transport{
+		Timeouts: http.Timeouts{
+			Connect: cfg.Timeout,
+			Send:    cfg.Timeout,
+			Read:    cfg.Timeout,
+		},
+		TLS: u.check_tls,
+	}
+
+	if u.ProxyProtocol {
+		// Probes have no client to announce
+		transport.ProxyProtocol = proxyproto.FormatV1(nil, nil)
+	}
+
+	return transport
+}
+
+func probe(server *Server, cfg config.HealthCheck, transport http.Transport) error {
+	res, err := http.Get(server.Host, server.Port, cfg.Path, http.RequestConfig{
+		Headers: map[string]string{
+			"connection": "close",
+		},
+		Transport: transport,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if int(res.Status) != cfg.ExpectedStatus {
+		return fmt.Errorf("unexpected status %d", res.Status)
+	}
+
+	return nil
+}
+
+// recordCheck flips the server state once rise consecutive probes passed
+// or fall consecutive probes failed
+func (s *Server) recordCheck(upstream_name string, err error, cfg config.HealthCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		s.fails = 0
+		s.passes++
+
+		if !s.up && s.passes >= cfg.Rise {
+			s.up = true
+			logTransition(logger.HEALTH_CHECK, logger.INFO, logger.UPSTREAM_UP, upstream_name, s.Address,
+				fmt.Sprintf("server is up after %d successful checks", s.passes))
+		}
+		return
+	}
+
+	s.passes = 0
+	s.fails++
+
+	if s.up && s.fails >= cfg.Fall {
+		s.up = false
+		logTransition(logger.HEALTH_CHECK, logger.WARN, logger.UPSTREAM_DOWN, upstream_name, s.Address,
+			fmt.Sprintf("server is down after %d failed checks: %s", s.fails, err))
+	}
+}
+
+func logTransition(service logger.Service, level logger.LogLevel, event logger.LogEvent, upstream_name string, address string, msg string) {
+	log := logger.NewRequestLog(service, level, event, fmt.Sprintf("%s (%s) %s", upstream_name, address, msg))
+
+	fmt.Println(log.ToText())
+}
@@ -0,0 +1,178 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"dreamproxy/proxyproto"
+	"errors"
+	"io"
+	"log"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckDefaults(t *testing.T) {
+	cfg := withDefaults(config.HealthCheck{})
+
+	if cfg.Interval != DEFAULT_CHECK_INTERVAL || cfg.Timeout != DEFAULT_CHECK_TIMEOUT || cfg.Path != DEFAULT_CHECK_PATH ||
+		cfg.ExpectedStatus != DEFAULT_CHECK_STATUS || cfg.Rise != DEFAULT_CHECK_RISE || cfg.Fall != DEFAULT_CHECK_FALL {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+
+	set := config.HealthCheck{Interval: time.Second, Timeout: time.Second, Path: "/health", ExpectedStatus: 204, Rise: 1, Fall: 5}
+	if got := withDefaults(set); got != set {
+		t.Errorf("configured values replaced: %+v", got)
+	}
+}
+
+func TestRecordCheck(t *testing.T) {
+	group, err := NewUpstream(config.Upstream{
+		Name:    "backend",
+		Servers: []config.UpstreamServer{{Address: "127.0.0.1:8000"}, {Address: "127.0.0.1:8001"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := withDefaults(config.HealthCheck{Rise: 2, Fall: 3})
+	server := group.Servers[0]
+	failed := errors.New("unexpected status 500")
+
+	// A pass resets the failures counted so far
+	server.recordCheck("backend", failed, cfg)
+	server.recordCheck("backend", failed, cfg)
+	server.recordCheck("backend", nil, cfg)
+	server.recordCheck("backend", failed, cfg)
+	server.recordCheck("backend", failed, cfg)
+	if !server.IsUp() {
+		t.Fatalf("server down before fall consecutive failures")
+	}
+
+	server.recordCheck("backend", failed, cfg)
+	if server.IsUp() {
+		t.Fatalf("server still up after fall consecutive failures")
+	}
+
+	// Down servers are skipped
+	for i := 0; i < 4; i++ {
+		next, err := group.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next == server {
+			t.Fatalf("down server selected")
+		}
+	}
+
+	server.recordCheck("backend", nil, cfg)
+	if server.IsUp() {
+		t.Fatalf("server up before rise consecutive passes")
+	}
+
+	server.recordCheck("backend", nil, cfg)
+	if !server.IsUp() {
+		t.Fatalf("server still down after rise consecutive passes")
+	}
+
+	group.Servers[1].recordCheck("backend", failed, withDefaults(config.HealthCheck{Fall: 1}))
+	if next, err := group.Next(); err != nil || next != server {
+		t.Fatalf("expected the server back in rotation, got %v %v", next, err)
+	}
+
+	server.recordCheck("backend", failed, withDefaults(config.HealthCheck{Fall: 1}))
+	if _, err := group.Next(); err == nil {
+		t.Fatalf("a server was selected while all are down")
+	}
+}
+
+// startProxyProtocolBackend answers 200 to requests that start with a
+// PROXY protocol header, and closes the others
+func startProxyProtocolBackend(t *testing.T) string {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(c net.Conn) {
+				defer c.Close()
+				if _, err := proxyproto.ReadHeader(c); err != nil {
+					return
+				}
+				if _, err := http.ReadFullHttpMessage(c); err != nil {
+					return
+				}
+				c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			}(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestProbeSendsProxyProtocol(t *testing.T) {
+	address := startProxyProtocolBackend(t)
+	cfg := withDefaults(config.HealthCheck{Timeout: time.Second})
+
+	for _, proxy_protocol := range []bool{true, false} {
+		group, err := NewUpstream(config.Upstream{
+			Name:          "backend",
+			Servers:       []config.UpstreamServer{{Address: address}},
+			ProxyProtocol: proxy_protocol,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = probe(group.Servers[0], cfg, group.checkTransport(cfg))
+
+		if proxy_protocol && err != nil {
+			t.Errorf("probe with proxy_protocol on failed: %v", err)
+		}
+		if !proxy_protocol && err == nil {
+			t.Errorf("probe without PROXY header passed")
+		}
+	}
+}
+
+func TestProbeUsesCheckTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	group, err := NewUpstream(config.Upstream{
+		Name:    "backend",
+		Servers: []config.UpstreamServer{{Address: server.Listener.Addr().String()}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := withDefaults(config.HealthCheck{Timeout: time.Second})
+
+	// Cleartext on the TLS port
+	if err := probe(group.Servers[0], cfg, group.checkTransport(cfg)); err == nil {
+		t.Error("cleartext probe of a TLS server passed")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	group.SetCheckTLS(&tls.Config{RootCAs: roots, ServerName: "example.com"})
+
+	if err := probe(group.Servers[0], cfg, group.checkTransport(cfg)); err != nil {
+		t.Errorf("TLS probe failed: %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"dreamproxy/config"
+	"dreamproxy/http"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server is a single backend of an upstream group
+type Server struct {
+	Address string
+	Host    string
+	Port    int
+
+	// Name of the owning upstream group, used in logs
+	group string
+
+	mu sync.Mutex
+	up bool
+
+	// Consecutive active health check results
+	passes int
+	fails  int
+
+	// Passive health checks
+	breaker breaker
+
+	// Configured with down, never up
+	down bool
+
+	// Keep-alive settings and max_conns, shared by every request to the server
+	Conns *http.ServerConns
+}
+
+func NewServer(address string) (*Server, error) {
+	// Unix sockets have no port, the whole address is the host
+	if http.IsUnixAddress(address) {
+		if address == http.UNIX_PREFIX {
+			return nil, fmt.Errorf("missing socket path in %s", address)
+		}
+		return &Server{Address: address, Host: address, up: true}, nil
+	}
+
+	host, port_str, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(port_str)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", address)
+	}
+
+	return &Server{
+		Address: address,
+		Host:    host,
+		Port:    port,
+		up:      true,
+	}, nil
+}
+
+func (s *Server) IsUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.up
+}
+
+// acquire reports whether the server can take a request, both according
+// to the active health checks and to its circuit breaker
+func (s *Server) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.up && s.admit(time.Now())
+}
+
+// Upstream is a named group of servers balanced in weighted round-robin
+type Upstream struct {
+	Name    string
+	Servers []*Server
+
+	// Servers in the order they are picked, each one appearing as many
+	// times as its weight
+	schedule []*Server
+
+	// Requests start with a PROXY protocol header carrying the client address
+	ProxyProtocol bool
+
+	health *config.HealthCheck
+	next   atomic.Uint64
+
+	// TLS settings of the health checks of groups reached over https
+	check_tls *tls.Config
+}
+
+func NewUpstream(cfg config.Upstream) (*Upstream, error) {
+	upstream := &Upstream{
+		Name:          cfg.Name,
+		ProxyProtocol: cfg.ProxyProtocol,
+		health:        cfg.HealthCheck,
+	}
+
+	fail_timeout := cfg.FailTimeout
+	if fail_timeout <= 0 {
+		fail_timeout = DEFAULT_FAIL_TIMEOUT
+	}
+
+	half_open_requests := cfg.HalfOpenRequests
+	if half_open_requests <= 0 {
+		half_open_requests = DEFAULT_HALF_OPEN_REQUESTS
+	}
+
+	for _, server_cfg := range cfg.Servers {
+		server, err := NewServer(server_cfg.Address)
+
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", cfg.Name, err)
+		}
+
+		server.group = cfg.Name
+
+		if server_cfg.Down {
+			server.down = true
+			server.up = false
+		}
+
+		server.Conns = http.NewServerConns(http.PoolConfig{
+			MaxIdle:     cfg.Keepalive,
+			MaxPerHost:  cfg.MaxConns,
+			IdleTimeout: cfg.KeepaliveTimeout,
+		})
+		server.breaker = breaker{
+			max_fails:          cfg.MaxFails,
+			fail_timeout:       fail_timeout,
+			half_open_requests: half_open_requests,
+		}
+
+		upstream.Servers = append(upstream.Servers, server)
+	}
+
+	upstream.schedule = schedule(upstream.Servers, cfg.Servers)
+
+	return upstream, nil
+}
+
+// schedule spreads the turns of the servers by weight, smoothly: weights
+// 5, 1, 1 give a a b a c a a rather than a a a a a b c
+func schedule(servers []*Server, cfgs []config.UpstreamServer) []*Server {
+	weights := make([]int, len(servers))
+	current := make([]int, len(servers))
+	total := 0
+
+	for i, cfg := range cfgs {
+		weights[i] = max(cfg.Weight, 1)
+		total += weights[i]
+	}
+
+	turns := make([]*Server, 0, total)
+
+	for range total {
+		best := 0
+
+		for i := range servers {
+			current[i] += weights[i]
+
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+
+		current[best] -= total
+		turns = append(turns, servers[best])
+	}
+
+	return turns
+}
+
+// Next returns the next server able to take a request, skipping the ones
+// configured or marked down by health checks, ejected by their circuit
+// breaker or listed in exclude (servers already tried for this request)
+func (u *Upstream) Next(exclude ...*Server) (*Server, error) {
+	count := uint64(len(u.schedule))
+
+	for i := uint64(0); i < count; i++ {
+		server := u.schedule[(u.next.Add(1)-1)%count]
+
+		if slices.Contains(exclude, server) {
+			continue
+		}
+
+		if server.acquire() {
+			return server, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no live upstream servers in %s", u.Name)
+}
+
+// SetCheckTLS makes the health checks of the group use TLS, it must be
+// called before they start
+func (u *Upstream) SetCheckTLS(cfg *tls.Config) {
+	u.check_tls = cfg
+}
+
+func (u *Upstream) CheckTLS() *tls.Config {
+	return u.check_tls
+}
+
+var upstreams = map[string]*Upstream{}
+
+// Init builds the upstream groups. It must be called once before serving
+// requests, followed by StartHealthChecks once their TLS settings are known.
+func Init(cfgs []config.Upstream) {
+	for _, cfg := range cfgs {
+		upstream, err := NewUpstream(cfg)
+
+		if err != nil {
+			panic(err)
+		}
+
+		upstreams[upstream.Name] = upstream
+	}
+}
+
+// StartHealthChecks starts the health checks of the groups built by Init
+func StartHealthChecks() {
+	for _, upstream := range upstreams {
+		upstream.startHealthChecks()
+	}
+}
+
+func Lookup(name string) *Upstream {
+	return upstreams[name]
+}
@@ -0,0 +1,69 @@
+package upstream
+
+import (
+	"dreamproxy/config"
+	"strings"
+	"testing"
+)
+
+func TestNextWeightsAndDown(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []config.UpstreamServer
+		want    string
+	}{
+		{
+			name:    "Round-robin",
+			servers: []config.UpstreamServer{{Address: "127.0.0.1:8000"}, {Address: "127.0.0.1:8001"}},
+			want:    "8000 8001 8000 8001",
+		},
+		{
+			name: "Smooth weights",
+			servers: []config.UpstreamServer{
+				{Address: "127.0.0.1:8000", Weight: 5},
+				{Address: "127.0.0.1:8001"},
+				{Address: "127.0.0.1:8002"},
+			},
+			want: "8000 8000 8001 8000 8002 8000 8000 8000 8000 8001",
+		},
+		{
+			name: "Down servers are skipped",
+			servers: []config.UpstreamServer{
+				{Address: "127.0.0.1:8000", Down: true},
+				{Address: "127.0.0.1:8001", Weight: 2},
+				{Address: "127.0.0.1:8002"},
+			},
+			want: "8001 8002 8001 8001 8002 8001",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group, err := NewUpstream(config.Upstream{Name: "backend", Servers: tt.servers})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			picked := []string{}
+			for range strings.Fields(tt.want) {
+				server, err := group.Next()
+				if err != nil {
+					t.Fatal(err)
+				}
+				picked = append(picked, server.Address[len("127.0.0.1:"):])
+			}
+
+			if got := strings.Join(picked, " "); got != tt.want {
+				t.Errorf("picked %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	group, err := NewUpstream(config.Upstream{Name: "backend", Servers: []config.UpstreamServer{{Address: "127.0.0.1:8000", Down: true}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, err := group.Next(); err == nil {
+		t.Errorf("down server %s picked", server.Address)
+	}
+}